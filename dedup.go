@@ -0,0 +1,119 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DedupStats describes the files replaced by hard links by Options.Dedup
+type DedupStats struct {
+	// Files is the number of files written as hard links instead
+	Files int
+
+	// BytesSaved is the total size of their contents
+	BytesSaved int64
+}
+
+// DedupStats returns the files deduplicated by SquashLayers
+func (e *Export) DedupStats() DedupStats {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.dedupStats
+}
+
+/*
+deduper finds regular files in the squash layer whose contents are identical to
+those of a file written before them. Hard links share an inode, so only files
+with the same metadata (mode, owner and PAX records, see dedupKey) are merged.
+Modification times are not compared: a link takes the time of the file it links
+to. Sparse files are left alone.
+
+Files are hashed lazily: a file is only read to hash it once another file with
+the same metadata and size comes along, so most files are read once, to write
+them
+*/
+type deduper struct {
+	e      *Export
+	source io.ReaderAt
+	base   int64
+
+	candidates map[string][]*dedupCandidate // by dedupKey
+}
+
+type dedupCandidate struct {
+	name    string // the name the file was written under
+	content fileLoc
+	digest  string // the digest of the contents, once known
+}
+
+func (e *Export) newDeduper(source io.ReaderAt, base int64) *deduper {
+	if !e.options.Dedup {
+		return nil
+	}
+	return &deduper{e: e, source: source, base: base, candidates: map[string][]*dedupCandidate{}}
+}
+
+// dedupKey identifies the metadata of header that an inode holds, but for the
+// times, which would keep most files from being merged
+func dedupKey(header *tar.Header) string {
+	records := make([]string, 0, len(header.PAXRecords))
+	for key, value := range header.PAXRecords {
+		switch key {
+		case "atime", "ctime", "mtime":
+		default:
+			records = append(records, fmt.Sprintf("%q=%q", key, value))
+		}
+	}
+	sort.Strings(records)
+	return fmt.Sprintf("%d %o %d:%d %q:%q %s", header.Size, header.Mode, header.Uid, header.Gid,
+		header.Uname, header.Gname, strings.Join(records, " "))
+}
+
+func (d *deduper) digest(loc fileLoc) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, d.e.contents(d.source, d.base, loc)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+link returns the name of a file written before that header, whose contents are
+described by content, can be a hard link to. If there is none, "" is returned
+and the file is remembered for the files after it. A nil d finds nothing
+*/
+func (d *deduper) link(header *tar.Header, content fileLoc) (string, error) {
+	if d == nil || header.Typeflag != tar.TypeReg || header.Size == 0 {
+		return "", nil
+	}
+	if _, sparse := d.e.sparse[content]; sparse {
+		return "", nil
+	}
+	key := dedupKey(header)
+	current := &dedupCandidate{name: header.Name, content: content}
+	if len(d.candidates[key]) > 0 {
+		var err error
+		if current.digest, err = d.digest(content); err != nil {
+			return "", err
+		}
+		for _, candidate := range d.candidates[key] {
+			if candidate.digest == "" {
+				if candidate.digest, err = d.digest(candidate.content); err != nil {
+					return "", err
+				}
+			}
+			if candidate.digest == current.digest {
+				d.e.dedupStats.Files++
+				d.e.dedupStats.BytesSaved += header.Size
+				return candidate.name, nil
+			}
+		}
+	}
+	d.candidates[key] = append(d.candidates[key], current)
+	return "", nil
+}
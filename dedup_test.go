@@ -0,0 +1,59 @@
+package libsquash
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSquashDedup(t *testing.T) {
+	file := func(name, data string, change func(e *testEntry)) testEntry {
+		entry := testFile(name, data)
+		if change != nil {
+			change(&entry)
+		}
+		return entry
+	}
+	img := testImage(t,
+		testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{
+			file("a", "same", nil),
+			file("other", "diff", nil),
+			file("mode", "same", func(e *testEntry) { e.header.Mode = 0600 }),
+			file("owner", "same", func(e *testEntry) { e.header.Uid = 1000 }),
+		}},
+		testLayer{cmd: "make install", entries: []testEntry{
+			file("newer", "same", func(e *testEntry) { e.header.ModTime = time.Unix(5000, 0) }),
+			file("owner2", "same", func(e *testEntry) { e.header.Uid = 1000 }),
+		}},
+	)
+
+	tests := []struct {
+		name  string
+		dedup bool
+		links map[string]string // by name, the file it links to
+		stats DedupStats
+	}{
+		{"off", false, map[string]string{}, DedupStats{}},
+		{"on", true, map[string]string{"newer": "a", "owner2": "owner"}, DedupStats{Files: 2, BytesSaved: 8}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, report := testSquash(t, img, Options{Dedup: test.dedup})
+			if report.Dedup != test.stats {
+				t.Errorf("got stats %+v, want %+v", report.Dedup, test.stats)
+			}
+			files, _ := readTestImage(t, squashLayerTar(t, out))
+			for _, name := range []string{"a", "other", "mode", "owner", "newer", "owner2"} {
+				want := "file same"
+				if name == "other" {
+					want = "file diff"
+				}
+				if target, ok := test.links[name]; ok {
+					want = "link " + target
+				}
+				if got := describeEntry(files[name]); got != want {
+					t.Errorf("%s: got %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/winchman/libsquash/tarball"
+)
+
+// ImageDiff is the difference between the filesystems of two images, see
+// DiffImages
+type ImageDiff struct {
+	// Changes are the paths that differ, sorted by path
+	Changes []PathChange `json:"changes"`
+}
+
+// PathChange is a path that differs between two images
+type PathChange struct {
+	Path string     `json:"path"`
+	Kind ChangeKind `json:"kind"`
+
+	// Fields are what differs for a modified path
+	Fields []ChangedField `json:"fields,omitempty"`
+}
+
+// ChangeKind classifies a PathChange
+type ChangeKind string
+
+const (
+	// ChangeAdded is for a path that is only in the second image
+	ChangeAdded ChangeKind = "added"
+
+	// ChangeRemoved is for a path that is only in the first image
+	ChangeRemoved ChangeKind = "removed"
+
+	// ChangeModified is for a path that is in both images, but differs
+	ChangeModified ChangeKind = "modified"
+)
+
+// ChangedField is a property of a file that differs between two images
+type ChangedField string
+
+const (
+	// FieldType is for a file replaced by one of another type, e.g. a
+	// directory by a symlink. The other fields are not compared then
+	FieldType ChangedField = "type"
+
+	// FieldContent is for a regular file with a different size or sha256
+	FieldContent ChangedField = "content"
+
+	// FieldMode is for different permission bits (including setuid, setgid
+	// and sticky)
+	FieldMode ChangedField = "mode"
+
+	// FieldOwner is for a different uid or gid
+	FieldOwner ChangedField = "owner"
+
+	// FieldLink is for a symlink with a different target
+	FieldLink ChangedField = "link"
+
+	// FieldXattrs is for different extended attributes
+	FieldXattrs ChangedField = "xattrs"
+
+	// FieldDevice is for a device node with different device numbers
+	FieldDevice ChangedField = "device"
+)
+
+/*
+DiffImages reads the image tarballs from a and b and compares their
+filesystems. Each filesystem is merged from all of the layers of its image
+(see mergeLayers), so whiteouts are applied and hard links compare as the files
+they link to. Modification times are not compared, and neither is the root
+directory.
+
+Each image is read as by IngestImageMetadata, and then once more for the
+contents of the regular files that are in both images with the same size, so
+an image that is not seekable is copied to a spill (see Options.Storage)
+*/
+func DiffImages(a, b io.Reader, opts Options) (*ImageDiff, error) {
+	before, err := openImageFiles(a, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer before.close()
+	after, err := openImageFiles(b, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer after.close()
+	return diffFiles(before, after)
+}
+
+// Empty returns whether the images compared are the same
+func (d *ImageDiff) Empty() bool {
+	return len(d.Changes) == 0
+}
+
+// diffFiles compares the filesystems before and after, see DiffImages
+func diffFiles(before, after *imageFiles) (*ImageDiff, error) {
+	ret := &ImageDiff{Changes: []PathChange{}}
+	var compared []string
+	for p := range before.files {
+		if _, ok := after.files[p]; !ok {
+			ret.Changes = append(ret.Changes, PathChange{Path: p, Kind: ChangeRemoved})
+		} else {
+			compared = append(compared, p)
+		}
+	}
+	for p := range after.files {
+		if _, ok := before.files[p]; !ok {
+			ret.Changes = append(ret.Changes, PathChange{Path: p, Kind: ChangeAdded})
+		}
+	}
+
+	// only the contents that the headers do not tell apart are hashed, unless
+	// both are the same entry (see openImageFiles)
+	var beforeLocs, afterLocs []fileLoc
+	for _, p := range compared {
+		if before.files[p].content == after.files[p].content {
+			continue
+		}
+		x, y := before.files[p].content.header, after.files[p].content.header
+		if fileType(x) == tar.TypeReg && fileType(y) == tar.TypeReg && x.Size == y.Size && x.Size > 0 {
+			beforeLocs = append(beforeLocs, before.files[p].content)
+			afterLocs = append(afterLocs, after.files[p].content)
+		}
+	}
+	beforeHashes, err := before.hashContents(beforeLocs)
+	if err != nil {
+		return nil, err
+	}
+	afterHashes, err := after.hashContents(afterLocs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range compared {
+		x, y := before.files[p].content, after.files[p].content
+		if x == y {
+			continue
+		}
+		if fields := compareFiles(x.header, y.header, beforeHashes[x] == afterHashes[y]); len(fields) > 0 {
+			ret.Changes = append(ret.Changes, PathChange{Path: p, Kind: ChangeModified, Fields: fields})
+		}
+	}
+	sort.Slice(ret.Changes, func(i, j int) bool {
+		return ret.Changes[i].Path < ret.Changes[j].Path
+	})
+	return ret, nil
+}
+
+// compareFiles returns the fields of the headers x and y that differ.
+// sameHash is whether the contents of x and y have the same sha256, for
+// regular files of the same size
+func compareFiles(x, y *tar.Header, sameHash bool) []ChangedField {
+	if fileType(x) != fileType(y) {
+		return []ChangedField{FieldType}
+	}
+	var ret []ChangedField
+	if fileType(x) == tar.TypeReg && (x.Size != y.Size || !sameHash) {
+		ret = append(ret, FieldContent)
+	}
+	if x.Mode&07777 != y.Mode&07777 {
+		ret = append(ret, FieldMode)
+	}
+	if x.Uid != y.Uid || x.Gid != y.Gid {
+		ret = append(ret, FieldOwner)
+	}
+	if x.Typeflag == tar.TypeSymlink && x.Linkname != y.Linkname {
+		ret = append(ret, FieldLink)
+	}
+	if !equalXattrs(xattrs(x), xattrs(y)) {
+		ret = append(ret, FieldXattrs)
+	}
+	if (x.Typeflag == tar.TypeChar || x.Typeflag == tar.TypeBlock) && (x.Devmajor != y.Devmajor || x.Devminor != y.Devminor) {
+		ret = append(ret, FieldDevice)
+	}
+	return ret
+}
+
+// fileType returns the type of the file described by header, with the
+// spellings of a regular file (including a sparse one) made the same
+func fileType(header *tar.Header) byte {
+	switch header.Typeflag {
+	case tar.TypeRegA, tar.TypeGNUSparse:
+		return tar.TypeReg
+	}
+	return header.Typeflag
+}
+
+// xattrs returns the extended attributes of header, by name
+func xattrs(header *tar.Header) map[string]string {
+	ret := map[string]string{}
+	for name, value := range header.Xattrs {
+		ret[name] = value
+	}
+	for key, value := range header.PAXRecords {
+		if name := strings.TrimPrefix(key, paxXattrPrefix); name != key {
+			ret[name] = value
+		}
+	}
+	return ret
+}
+
+func equalXattrs(x, y map[string]string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for name, value := range x {
+		if other, ok := y[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// imageFiles is the merged filesystem of an image tarball, and where the
+// contents of its files can be read from
+type imageFiles struct {
+	export *Export
+	files  map[string]*fsNode // by tree path, without the root
+	source io.ReaderAt
+	base   int64
+	spill  Spill // the copy of the image tarball, if it is not seekable
+
+	lower   *imageFiles     // the image the files of the grafted layers come from
+	grafted map[string]bool // the layers whose files come from lower
+}
+
+/*
+openImageFiles ingests the image tarball from instream and merges its layers.
+The caller closes the result.
+
+If lower is not nil, the layers that are in both images but have no entries in
+this one take the entries they have in lower. That is how a squashed image
+leaves out the layers below the squash point, which the daemon has already
+(see RebuildImage). The files of such layers are the same entries on both
+sides, so they compare equal without being read
+*/
+func openImageFiles(instream io.Reader, opts Options, lower *imageFiles) (*imageFiles, error) {
+	ret := &imageFiles{export: NewExportWithOptions(opts), files: map[string]*fsNode{}, lower: lower, grafted: map[string]bool{}}
+	if source, base, ok := seekable(instream); ok {
+		ret.source, ret.base = source, base
+		if err := ret.export.IngestImageMetadata(instream); err != nil {
+			return nil, err
+		}
+	} else {
+		spill, err := ret.export.createSpill()
+		if err != nil {
+			return nil, wrapError(PhaseIngest, "", "", err)
+		}
+		ret.source, ret.spill = spill, spill
+		if err := ret.export.IngestImageMetadata(io.TeeReader(instream, spill)); err != nil {
+			ret.close()
+			return nil, err
+		}
+	}
+
+	e := ret.export
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if lower != nil {
+		ret.graft()
+	}
+	tree := newFSTree()
+	if _, err := e.mergeImage(tree); err != nil {
+		ret.close()
+		return nil, err
+	}
+	tree.walk(func(p string, node *fsNode) {
+		if p != "" {
+			ret.files[p] = node
+		}
+	})
+	return ret, nil
+}
+
+// graft adds the entries of the layers of f.lower to the layers of f that are
+// empty, see openImageFiles. The lock of f.export is held
+func (f *imageFiles) graft() {
+	lower := f.lower.export
+	lower.lock.RLock()
+	defer lower.lock.RUnlock()
+
+	hasEntries := map[string]bool{}
+	for _, locs := range f.export.fileToLayers {
+		for _, loc := range locs {
+			hasEntries[loc.uuid] = true
+		}
+	}
+	for _, layer := range f.export.chain() {
+		id := layer.LayerConfig.ID
+		if !hasEntries[id] && lower.Layers[id] != nil {
+			f.grafted[id] = true
+		}
+	}
+	for p, locs := range lower.fileToLayers {
+		for _, loc := range locs {
+			if f.grafted[loc.uuid] {
+				f.export.fileToLayers[p] = append(f.export.fileToLayers[p], loc)
+			}
+		}
+	}
+}
+
+func (f *imageFiles) close() {
+	if f.spill != nil {
+		f.export.releaseSpill(f.spill)
+		f.spill = nil
+	}
+}
+
+// hashContents returns the sha256 of the contents of the files at locs
+func (f *imageFiles) hashContents(locs []fileLoc) (map[fileLoc]string, error) {
+	var own, lower []fileLoc
+	for _, loc := range locs {
+		if f.grafted[loc.uuid] {
+			lower = append(lower, loc)
+		} else {
+			own = append(own, loc)
+		}
+	}
+	ret := map[fileLoc]string{}
+	if len(lower) > 0 {
+		hashes, err := f.lower.hashContents(lower)
+		if err != nil {
+			return nil, err
+		}
+		for loc, hash := range hashes {
+			ret[loc] = hash
+		}
+	}
+
+	f.export.lock.Lock()
+	defer f.export.lock.Unlock()
+	hashes, err := f.export.hashContents(f.source, f.base, own)
+	if err != nil {
+		return nil, err
+	}
+	for loc, hash := range hashes {
+		ret[loc] = hash
+	}
+	return ret, nil
+}
+
+/*
+hashContents returns the sha256 of the contents of each of the files at locs,
+in the image tarball at base in source. Each layer.tar with such files is read
+once, on a bounded number of goroutines (see Options.Concurrency), and the
+files are found by their position in it. Reading them with the tar reader
+gives the full contents of sparse files as well
+*/
+func (e *Export) hashContents(source io.ReaderAt, base int64, locs []fileLoc) (map[fileLoc]string, error) {
+	needed := map[string]map[int]fileLoc{} // by layer, then index
+	for _, loc := range locs {
+		if needed[loc.uuid] == nil {
+			needed[loc.uuid] = map[int]fileLoc{}
+		}
+		needed[loc.uuid][loc.index] = loc
+	}
+	uuids := make([]string, 0, len(needed))
+	for uuid := range needed {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	hashes := make([]map[fileLoc]string, len(uuids))
+	if err := parallelize(len(uuids), e.options.concurrency(), func(i int) error {
+		uuid := uuids[i]
+		hashes[i] = map[fileLoc]string{}
+		layerTar := io.NewSectionReader(source, base+e.layerOffsets[uuid], e.Layers[uuid].LayerTarHeader.Size)
+		index := -1
+		if err := tarball.Walk(layerTar, func(tf *tarball.TarFile) error {
+			index++
+			loc, ok := needed[uuid][index]
+			if !ok {
+				return nil
+			}
+			digest := sha256.New()
+			if _, err := io.Copy(digest, tf.Stream); err != nil {
+				return err
+			}
+			hashes[i][loc] = hex.EncodeToString(digest.Sum(nil))
+			return nil
+		}); err != nil {
+			return wrapError(PhaseIngest, uuid, uuid+"/layer.tar", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	ret := map[fileLoc]string{}
+	for _, layerHashes := range hashes {
+		for loc, hash := range layerHashes {
+			ret[loc] = hash
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,47 @@
+package libsquash
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDiffImages(t *testing.T) {
+	withXattr := func(entry testEntry, value string) testEntry {
+		entry.header.PAXRecords = map[string]string{paxXattrPrefix + "security.capability": value}
+		return entry
+	}
+	base := []testEntry{testDir("bin/"), withXattr(testFile("bin/ping", "ping"), "a"), testFile("bin/sh", "sh"), testFile("bin/old", "o")}
+	a := testImage(t, testLayer{cmd: "#(nop) ADD file:a in /", entries: base})
+	b := testImage(t,
+		testLayer{cmd: "#(nop) ADD file:a in /", entries: base},
+		testLayer{cmd: "make install", entries: []testEntry{
+			withXattr(testFile("bin/ping", "ping"), "b"),
+			testFile("bin/sh", "bash"),
+			testFile("bin/.wh.old", ""),
+			testFile("bin/new", "n"),
+		}},
+	)
+
+	diff, err := DiffImages(bytes.NewReader(a), bytes.NewReader(b), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PathChange{
+		{Path: "bin/new", Kind: ChangeAdded},
+		{Path: "bin/old", Kind: ChangeRemoved},
+		{Path: "bin/ping", Kind: ChangeModified, Fields: []ChangedField{FieldXattrs}},
+		{Path: "bin/sh", Kind: ChangeModified, Fields: []ChangedField{FieldContent}},
+	}
+	if !reflect.DeepEqual(diff.Changes, want) {
+		t.Errorf("got %+v, want %+v", diff.Changes, want)
+	}
+
+	same, err := DiffImages(bytes.NewReader(a), bytes.NewReader(a), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same.Empty() {
+		t.Errorf("got %+v for the same image", same.Changes)
+	}
+}
@@ -0,0 +1,364 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxSymlinkHops is how many symlinks are followed while resolving a path
+// before giving up, like the limit of the kernel
+const maxSymlinkHops = 40
+
+// treePath returns the name of a file in a layer.tar as a path from the root
+// of the filesystem, without a leading "./" or "/" or a trailing "/". The root
+// itself is ""
+func treePath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// splitTreePath splits tree path p into its parent directory and its name
+func splitTreePath(p string) (dir, name string) {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return "", p
+}
+
+// fsNode is a file in the merged filesystem of the layers, see mergeLayers
+type fsNode struct {
+	loc      fileLoc            // the entry the file comes from
+	content  fileLoc            // the entry with its contents; for a hard link, that of the file linked to
+	implicit bool               // for a parent directory that no layer has an entry for
+	children map[string]*fsNode // by name, nil unless the file is a directory
+}
+
+func (n *fsNode) isSymlink() bool {
+	return n.content.header.Typeflag == tar.TypeSymlink
+}
+
+func (n *fsNode) isDir() bool {
+	return n.content.header.Typeflag == tar.TypeDir
+}
+
+/*
+fsTree is the filesystem that results from extracting the layers on top of each
+other, which is what a container sees. It is built by mergeLayers, and the
+squash layer is written from it
+*/
+type fsTree struct {
+	root *fsNode
+
+	// onRemove, if not nil, is called for each file that an entry removes
+	// from the tree, see removed
+	onRemove func(p string, node *fsNode, by fileLoc, deleted bool)
+}
+
+func newFSTree() *fsTree {
+	return &fsTree{root: &fsNode{
+		content:  fileLoc{header: &tar.Header{Typeflag: tar.TypeDir}},
+		implicit: true,
+		children: map[string]*fsNode{},
+	}}
+}
+
+// lookup returns the file at tree path p (which must already be resolved, see
+// resolve), or nil
+func (t *fsTree) lookup(p string) *fsNode {
+	node := t.root
+	if p == "" {
+		return node
+	}
+	for _, name := range strings.Split(p, "/") {
+		if node = node.children[name]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+/*
+resolve returns the tree path that the file named name refers to, once the
+symlinks among its parent directories are followed, the way they are when a
+layer is extracted. The last component is not followed, since a layer replaces
+a symlink rather than writing through it. ok is false if more than
+maxSymlinkHops symlinks are followed.
+
+An absolute target is followed from the root of the tree, and a relative one
+stops at the root, as in a container. escaped reports whether a target was
+absolute or led above the root, either of which would write outside of the
+directory the layers are extracted to if they were extracted naively
+*/
+func (t *fsTree) resolve(name string) (resolved string, escaped, ok bool) {
+	parts := strings.Split(treePath(name), "/")
+	hops := 0
+	for len(parts) > 1 {
+		next := path.Join(resolved, parts[0])
+		parts = parts[1:]
+		if node := t.lookup(next); node != nil && node.isSymlink() {
+			if hops++; hops > maxSymlinkHops {
+				return "", escaped, false
+			}
+			// continue from the target, relative to the directory of the
+			// symlink unless it is absolute
+			target := node.content.header.Linkname
+			if path.IsAbs(target) {
+				escaped = true
+			} else {
+				if checkPath(path.Join(resolved, target)) != nil {
+					escaped = true
+				}
+				target = path.Join("/", resolved, target)
+			}
+			if target := treePath(target); target != "" {
+				parts = append(strings.Split(target, "/"), parts...)
+			}
+			resolved = ""
+			continue
+		}
+		resolved = next
+	}
+	return path.Join(resolved, parts[0]), escaped, true
+}
+
+// mkdirAll returns the directory at tree path p, adding implicit directories
+// for the missing parts. A part that exists but is not a directory is replaced
+// by an implicit directory as well. loc is the entry that needs them
+func (t *fsTree) mkdirAll(p string, loc fileLoc) *fsNode {
+	node := t.root
+	if p == "" {
+		return node
+	}
+	walked := ""
+	for _, name := range strings.Split(p, "/") {
+		walked = path.Join(walked, name)
+		child := node.children[name]
+		if child == nil || !child.isDir() {
+			if child != nil {
+				t.removed(walked, child, loc, false)
+			}
+			implicit := fileLoc{uuid: loc.uuid, header: &tar.Header{
+				Name:     walked + "/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  loc.header.ModTime,
+			}}
+			child = &fsNode{loc: implicit, content: implicit, implicit: true, children: map[string]*fsNode{}}
+			node.children[name] = child
+		}
+		node = child
+	}
+	return node
+}
+
+/*
+mergeLayers replays the entries of the layers in the chain from e.start, in
+order, on an empty fsTree. Within a layer, the entries are replayed in the
+order of the layer.tar, so when a path appears more than once, the last entry
+wins, as it does on extraction:
+
+1. an entry is placed at the path it resolves to (see fsTree.resolve), so a
+file written under a symlinked directory ends up in the directory the symlink
+points to
+
+2. a whiteout (.wh.<name>) deletes the file it names and everything under it,
+and an opaque whiteout (.wh..wh..opq) deletes the contents of its directory
+from the layers below, also under the directories its own layer kept
+
+3. a hard link is resolved to the file its target refers to at that point, so
+later changes to the target do not affect it (see resolveHardLinks)
+
+4. a directory entry over an existing directory only updates its metadata, and
+keeps the files under it. Any other entry replaces what was at its path, so a
+change of type (e.g. a directory replaced by a file, or by a symlink) hides
+everything that was under it in the layers below, as it does at runtime
+*/
+func (e *Export) mergeLayers() (*fsTree, error) {
+	tree := newFSTree()
+	if err := e.mergeChain(e.order, tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// mergeImage replays all of the layers of the image, from the root, on tree
+// (see mergeLayers), and returns the position of each layer in the chain. It
+// records no warnings, since ingest records those of the layers it merges
+func (e *Export) mergeImage(tree *fsTree) (map[string]int, error) {
+	order := map[string]int{}
+	for i, layer := range e.chain() {
+		order[layer.LayerConfig.ID] = i
+	}
+	warnings := e.warnings
+	err := e.mergeChain(order, tree)
+	e.warnings = warnings
+	return order, err
+}
+
+// mergeChain replays the entries of the layers in order (the position of each
+// layer in the chain) on tree, see mergeLayers
+func (e *Export) mergeChain(order map[string]int, tree *fsTree) error {
+	var locs []fileLoc
+	for _, fileLocs := range e.fileToLayers {
+		for _, loc := range fileLocs {
+			if _, ok := order[loc.uuid]; ok {
+				locs = append(locs, loc)
+			}
+		}
+	}
+	sort.Slice(locs, func(i, j int) bool {
+		return before(order, locs[i], locs[j])
+	})
+
+	for _, loc := range locs {
+		if err := e.mergeEntry(tree, loc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeEntry replays the entry at loc on tree. The entries that are written
+// through a symlink whose target is absolute or leads above the root are
+// handled according to Options.UnsafePaths
+func (e *Export) mergeEntry(tree *fsTree, loc fileLoc) error {
+	resolved, escaped, ok := tree.resolve(loc.header.Name)
+	if !ok {
+		e.warn(WarningUnresolvablePath, loc.uuid, loc.header.Name, "too many levels of symbolic links, ignoring it")
+		return nil
+	}
+	if !escaped && loc.header.Typeflag == tar.TypeLink {
+		_, escaped, _ = tree.resolve(loc.header.Linkname)
+	}
+	if escaped {
+		keep, w, err := applyPathPolicy(e.options.UnsafePaths, loc.uuid, loc.header.Name, ErrorSymlinkEscape)
+		if w != nil {
+			e.warn(w.Kind, w.LayerID, w.Entry, w.Message)
+		}
+		if !keep {
+			return err
+		}
+	}
+	if resolved == "" {
+		// the root directory itself
+		if loc.header.Typeflag == tar.TypeDir {
+			tree.root.loc, tree.root.content, tree.root.implicit = loc, loc, false
+		}
+		return nil
+	}
+
+	dir, name := splitTreePath(resolved)
+	switch {
+	case name == ".wh..wh..opq":
+		if parent := tree.lookup(dir); parent != nil {
+			tree.removeLower(dir, parent, loc)
+		}
+	case strings.HasPrefix(name, ".wh."):
+		if parent := tree.lookup(dir); parent != nil {
+			deleted := strings.TrimPrefix(name, ".wh.")
+			if child := parent.children[deleted]; child != nil {
+				delete(parent.children, deleted)
+				tree.removed(path.Join(dir, deleted), child, loc, true)
+			}
+		}
+	default:
+		content := loc
+		if loc.header.Typeflag == tar.TypeLink {
+			if content, ok = tree.linkTarget(loc.header.Linkname); !ok {
+				e.warn(WarningDanglingHardLink, loc.uuid, loc.header.Name, fmt.Sprintf("target %q of hard link does not exist, dropping it", loc.header.Linkname))
+				return nil
+			}
+		}
+		parent := tree.mkdirAll(dir, loc)
+		node := parent.children[name]
+		if node != nil && node.isDir() && content.header.Typeflag == tar.TypeDir {
+			node.loc, node.content, node.implicit = loc, content, false
+			return nil
+		}
+		if node != nil {
+			tree.removed(resolved, node, loc, false)
+		}
+		node = &fsNode{loc: loc, content: content}
+		if node.isDir() {
+			node.children = map[string]*fsNode{}
+		}
+		parent.children[name] = node
+	}
+	return nil
+}
+
+// removeLower removes the files under the directory node, at tree path p, that
+// come from the layers below the opaque whiteout at by. The directories of the
+// layer of by are kept, but they are opaque as well
+func (t *fsTree) removeLower(p string, node *fsNode, by fileLoc) {
+	for name, child := range node.children {
+		switch {
+		case child.loc.uuid != by.uuid:
+			delete(node.children, name)
+			t.removed(path.Join(p, name), child, by, true)
+		case child.children != nil:
+			t.removeLower(path.Join(p, name), child, by)
+		}
+	}
+}
+
+// removed calls t.onRemove for node, at tree path p, and each file under it,
+// which the entry at by has removed from t. deleted is whether by is a
+// whiteout, rather than an entry replacing node
+func (t *fsTree) removed(p string, node *fsNode, by fileLoc, deleted bool) {
+	if t.onRemove == nil {
+		return
+	}
+	t.onRemove(p, node, by, deleted)
+	for name, child := range node.children {
+		t.removed(path.Join(p, name), child, by, deleted)
+	}
+}
+
+// before returns whether the file at a comes before the one at b, given the
+// position of each layer in the chain
+func before(order map[string]int, a, b fileLoc) bool {
+	if a.uuid != b.uuid {
+		return order[a.uuid] < order[b.uuid]
+	}
+	return a.index < b.index
+}
+
+// linkTarget returns the entry with the contents of the file that a hard link
+// to name refers to
+func (t *fsTree) linkTarget(name string) (fileLoc, bool) {
+	resolved, _, ok := t.resolve(name)
+	if !ok {
+		return fileLoc{}, false
+	}
+	node := t.lookup(resolved)
+	if node == nil || node.implicit || node.isDir() {
+		return fileLoc{}, false
+	}
+	return node.content, true
+}
+
+// walk calls fn for each file in the tree, parents first and siblings sorted
+// by name. The root is only included if a layer has an entry for it
+func (t *fsTree) walk(fn func(p string, node *fsNode)) {
+	var walk func(p string, node *fsNode)
+	walk = func(p string, node *fsNode) {
+		names := make([]string, 0, len(node.children))
+		for name := range node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := node.children[name]
+			childPath := path.Join(p, name)
+			fn(childPath, child)
+			walk(childPath, child)
+		}
+	}
+	if !t.root.implicit {
+		fn("", t.root)
+	}
+	walk("", t.root)
+}
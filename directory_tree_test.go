@@ -0,0 +1,202 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// mergeTestLayers replays layers of entries on tree with mergeEntry. The id
+// of each layer is its position
+func mergeTestLayers(t *testing.T, e *Export, tree *fsTree, layers [][]testEntry) {
+	for i, entries := range layers {
+		for index, entry := range entries {
+			header := entry.header
+			loc := fileLoc{uuid: strconv.Itoa(i), header: &header, index: index}
+			if err := e.mergeEntry(tree, loc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// describeTree describes the files of tree, by path, as their type and the
+// layer of their entry, and of their contents if that is another one
+func describeTree(tree *fsTree) map[string]string {
+	ret := map[string]string{}
+	tree.walk(func(p string, node *fsNode) {
+		var kind string
+		switch node.content.header.Typeflag {
+		case tar.TypeDir:
+			kind = "dir"
+		case tar.TypeSymlink:
+			kind = "symlink"
+		default:
+			kind = "file"
+		}
+		switch {
+		case node.implicit:
+			kind += " implicit"
+		case node.loc != node.content:
+			kind += " " + node.loc.uuid + " of " + node.content.header.Name + " " + node.content.uuid
+		default:
+			kind += " " + node.loc.uuid
+		}
+		ret[p] = kind
+	})
+	return ret
+}
+
+func TestMergeEntry(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]testEntry
+		want   map[string]string
+	}{
+		{
+			name: "file replaced",
+			layers: [][]testEntry{
+				{testDir("etc/"), testFile("etc/hosts", "a")},
+				{testFile("etc/hosts", "b")},
+			},
+			want: map[string]string{"etc": "dir 0", "etc/hosts": "file 1"},
+		},
+		{
+			name: "directory over directory",
+			layers: [][]testEntry{
+				{testDir("etc/"), testFile("etc/hosts", "a")},
+				{testDir("./etc")},
+			},
+			want: map[string]string{"etc": "dir 1", "etc/hosts": "file 0"},
+		},
+		{
+			name: "implicit parents",
+			layers: [][]testEntry{
+				{testFile("usr/bin/env", "a")},
+			},
+			want: map[string]string{"usr": "dir implicit", "usr/bin": "dir implicit", "usr/bin/env": "file 0"},
+		},
+		{
+			name: "root entry",
+			layers: [][]testEntry{
+				{testDir("./"), testFile("a", "a")},
+			},
+			want: map[string]string{"": "dir 0", "a": "file 0"},
+		},
+		{
+			name: "whiteout",
+			layers: [][]testEntry{
+				{testDir("opt/"), testDir("opt/app/"), testFile("opt/app/bin", "a"), testFile("opt/keep", "k")},
+				{testFile("opt/.wh.app", "")},
+			},
+			want: map[string]string{"opt": "dir 0", "opt/keep": "file 0"},
+		},
+		{
+			name: "whiteout of a missing file",
+			layers: [][]testEntry{
+				{testFile("a", "a")},
+				{testFile(".wh.b", ""), testFile("missing/.wh.c", "")},
+			},
+			want: map[string]string{"a": "file 0"},
+		},
+		{
+			name: "opaque whiteout",
+			layers: [][]testEntry{
+				{testDir("var/"), testFile("var/old", "o"), testDir("var/lib/"), testFile("var/lib/db", "d")},
+				{testDir("var/"), testFile("var/new", "n"), testFile("var/.wh..wh..opq", ""), testFile("var/newer", "n")},
+			},
+			want: map[string]string{"var": "dir 1", "var/new": "file 1", "var/newer": "file 1"},
+		},
+		{
+			name: "opaque whiteout under a kept directory",
+			layers: [][]testEntry{
+				{testDir("var/"), testDir("var/lib/"), testFile("var/lib/db", "d"), testDir("var/lib/apt/"), testFile("var/lib/apt/lists", "l")},
+				{testDir("var/"), testDir("var/lib/"), testDir("var/lib/apt/"), testFile("var/lib/new", "n"), testFile("var/.wh..wh..opq", "")},
+			},
+			want: map[string]string{"var": "dir 1", "var/lib": "dir 1", "var/lib/apt": "dir 1", "var/lib/new": "file 1"},
+		},
+		{
+			name: "opaque whiteout leaves lower layers",
+			layers: [][]testEntry{
+				{testDir("a/"), testFile("a/x", "x")},
+				{testDir("b/"), testFile("b/.wh..wh..opq", "")},
+			},
+			want: map[string]string{"a": "dir 0", "a/x": "file 0", "b": "dir 1"},
+		},
+		{
+			name: "directory replaced by a file",
+			layers: [][]testEntry{
+				{testDir("opt/"), testDir("opt/app/"), testFile("opt/app/x", "x")},
+				{testFile("opt/app", "now a file")},
+			},
+			want: map[string]string{"opt": "dir 0", "opt/app": "file 1"},
+		},
+		{
+			name: "directory replaced by a symlink",
+			layers: [][]testEntry{
+				{testDir("usr/"), testDir("usr/lib/"), testFile("usr/lib/a", "a"), testDir("real/")},
+				{testSymlink("usr/lib", "../real"), testFile("usr/lib/b", "b")},
+			},
+			want: map[string]string{"usr": "dir 0", "usr/lib": "symlink 1", "real": "dir 0", "real/b": "file 1"},
+		},
+		{
+			name: "relative symlink",
+			layers: [][]testEntry{
+				{testDir("lib/"), testSymlink("lib64", "lib")},
+				{testFile("lib64/libc.so", "c"), testFile("lib64/../etc/x", "x")},
+			},
+			want: map[string]string{"lib": "dir 0", "lib64": "symlink 0", "lib/libc.so": "file 1", "etc": "dir implicit", "etc/x": "file 1"},
+		},
+		{
+			name: "hard link to a replaced file",
+			layers: [][]testEntry{
+				{testFile("a", "a"), testLink("b", "a")},
+				{testFile("a", "new")},
+			},
+			want: map[string]string{"a": "file 1", "b": "file 0 of a 0"},
+		},
+		{
+			name: "hard link through a symlink",
+			layers: [][]testEntry{
+				{testDir("real/"), testFile("real/a", "a"), testSymlink("dir", "real")},
+				{testLink("b", "dir/a")},
+			},
+			want: map[string]string{"real": "dir 0", "real/a": "file 0", "dir": "symlink 0", "b": "file 1 of real/a 0"},
+		},
+		{
+			name: "dangling hard link",
+			layers: [][]testEntry{
+				{testLink("b", "missing")},
+			},
+			want: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree := newFSTree()
+			mergeTestLayers(t, NewExport(), tree, test.layers)
+			got := describeTree(tree)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMergeEntryRemoved(t *testing.T) {
+	tree := newFSTree()
+	removed := map[string]string{}
+	tree.onRemove = func(p string, node *fsNode, by fileLoc, deleted bool) {
+		removed[p] = by.uuid + " " + strconv.FormatBool(deleted)
+	}
+	mergeTestLayers(t, NewExport(), tree, [][]testEntry{
+		{testDir("var/"), testDir("var/lib/"), testFile("var/lib/db", "d"), testFile("etc", "e"), testFile("x", "x")},
+		{testDir("var/lib/"), testFile("var/.wh..wh..opq", ""), testFile("x", "y")},
+		{testDir("etc/")},
+	})
+	want := map[string]string{"var/lib/db": "1 true", "x": "1 false", "etc": "2 false"}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("got removed %q, want %q", removed, want)
+	}
+}
@@ -0,0 +1,78 @@
+package libsquash
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Phase identifies the step of a squash during which an error occurred
+type Phase string
+
+const (
+	// PhaseIngest is the first pass over the image, see IngestImageMetadata
+	PhaseIngest Phase = "ingest"
+
+	// PhaseSquash is the second pass over the image, see SquashLayers
+	PhaseSquash Phase = "squash"
+
+	// PhaseRebuild is the writing of the final image tarball, see RebuildImage
+	PhaseRebuild Phase = "rebuild"
+)
+
+/*
+Error is the type of the errors returned by IngestImageMetadata, SquashLayers,
+RebuildImage and Squash. It records where in the image the failure happened
+and wraps the underlying cause, so it can be inspected with errors.As and the
+cause (e.g. ErrorNoFROM or io.ErrUnexpectedEOF) matched with errors.Is. These
+functions never return the Error* variables of this package unwrapped:
+
+	var squashErr *libsquash.Error
+	if errors.As(err, &squashErr) {
+		log.Printf("failed in layer %s at %s", squashErr.LayerID, squashErr.Entry)
+	}
+*/
+type Error struct {
+	// Phase is the step of the squash that failed
+	Phase Phase
+
+	// LayerID is the id of the layer being processed, if any
+	LayerID string
+
+	// Entry is the name of the tar entry being processed, if any. For files
+	// inside of a layer.tar, this is the name within the layer.tar
+	Entry string
+
+	// Err is the underlying cause
+	Err error
+}
+
+func (e *Error) Error() string {
+	parts := []string{"libsquash", string(e.Phase)}
+	if e.LayerID != "" {
+		parts = append(parts, "layer "+truncateID(e.LayerID))
+	}
+	if e.Entry != "" {
+		parts = append(parts, fmt.Sprintf("entry %q", e.Entry))
+	}
+	return fmt.Sprintf("%s: %v", strings.Join(parts, ": "), e.Err)
+}
+
+// Unwrap returns the underlying cause of e
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrapError annotates err with the phase, layer and entry it occurred in. nil
+// is returned as nil, and an err that is already an *Error is returned as is
+// so that the innermost (most specific) context is kept
+func wrapError(phase Phase, layerID, entry string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var existing *Error
+	if errors.As(err, &existing) {
+		return err
+	}
+	return &Error{Phase: phase, LayerID: layerID, Entry: entry, Err: err}
+}
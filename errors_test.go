@@ -0,0 +1,55 @@
+package libsquash
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestIngestErrorContext(t *testing.T) {
+	img := testImage(t,
+		testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testDir("etc/"), testFile("etc/passwd", "root")}},
+		testLayer{cmd: "make install", entries: []testEntry{testFile("big", string(make([]byte, 4096)))}},
+	)
+	files, names := readTestImage(t, img)
+	last := names[len(names)-1]
+	if last != testLayerID(1)+"/layer.tar" {
+		t.Fatalf("got last entry %s", last)
+	}
+	// cut the image in the middle of the contents of the last layer.tar
+	truncated := img[:len(img)-1024-len(files[last].data)/2]
+
+	tests := []struct {
+		name  string
+		input io.Reader
+	}{
+		{"seekable", bytes.NewReader(truncated)},
+		{"stream", io.MultiReader(bytes.NewReader(truncated))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := NewExport().IngestImageMetadata(test.input)
+			var squashErr *Error
+			if !errors.As(err, &squashErr) {
+				t.Fatalf("got %v, want an *Error", err)
+			}
+			if squashErr.Phase != PhaseIngest || squashErr.LayerID != testLayerID(1) || squashErr.Entry != last {
+				t.Errorf("got phase %q, layer %q and entry %q, want %q, %q and %q", squashErr.Phase, squashErr.LayerID, squashErr.Entry, PhaseIngest, testLayerID(1), last)
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+			}
+		})
+	}
+}
+
+func TestWrapErrorKeepsInnermost(t *testing.T) {
+	inner := wrapError(PhaseIngest, "layer", "entry", io.EOF)
+	if err := wrapError(PhaseSquash, "", "", inner); err != inner {
+		t.Errorf("got %v, want %v", err, inner)
+	}
+	if err := wrapError(PhaseSquash, "", "", nil); err != nil {
+		t.Errorf("got %v for nil", err)
+	}
+}
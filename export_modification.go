@@ -3,35 +3,48 @@ package libsquash
 import (
 	"fmt"
 	"strings"
-	"time"
 )
 
 /*
 InsertLayer inserts a new layer after "parent" with the token #(squash)
-command. Return the new layer
+command and the config of "parent". Return the new layer
 */
 func (e *Export) InsertLayer(parent string) (*Layer, error) {
-	id, err := newID()
-	if err != nil {
-		return nil, err
-	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.insertLayer(parent)
+}
 
-	layerConfig := NewLayerConfig(id, parent, "squashed w/ libsquash")
-	layerConfig.ContainerConfig().Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(squash) from %s", parent[:12])}
+func (e *Export) insertLayer(parent string) (*Layer, error) {
+	layerConfig := NewLayerConfig("", parent, "squashed w/ libsquash")
+	layerConfig.ContainerConfig().Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(squash) from %s", truncateID(parent))}
 
 	entry := &Layer{
 		LayerConfig: layerConfig,
 	}
 
-	entry.LayerConfig.Created = time.Now().UTC()
+	entry.LayerConfig.Created = e.now()
+
+	// copy this so we don't lose important metadata like ENV vars and ENTRYPOINT
+	if layer, ok := e.Layers[parent]; ok {
+		entry.LayerConfig.Config = layer.LayerConfig.Config
+	}
+
+	// the contents are not known yet, see SquashLayers
+	id, err := e.newLayerID(entry, emptyLayerDigest())
+	if err != nil {
+		return nil, err
+	}
+	entry.LayerConfig.ID = id
 
 	// rewrite child json
-	child := e.ChildOf(parent)
-	if child != nil {
+	for _, child := range e.childrenOf(parent) {
 		child.LayerConfig.Parent = id
+		e.graph.setParent(child.LayerConfig.ID, id)
 	}
 
 	e.Layers[id] = entry
+	e.graph.add(id, parent)
 
 	return entry, err
 }
@@ -41,17 +54,28 @@ ReplaceLayer refreshes layer "orig" by updating the Created timestamp and ID
 and wiring it in correctly
 */
 func (e *Export) ReplaceLayer(orig *Layer) error {
-	newID, err := newID()
-	if err != nil {
-		return err
-	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.replaceLayer(orig)
+}
 
+func (e *Export) replaceLayer(orig *Layer) error {
 	oldID := orig.LayerConfig.ID
-	child := e.ChildOf(oldID)
+	children := e.childrenOf(oldID)
 
 	newLayer := orig.Clone()
 
-	newLayer.LayerConfig.Created = time.Now().UTC()
+	if e.options.Reproducible {
+		newLayer.LayerConfig.Created = e.clampTime(newLayer.LayerConfig.Created)
+	} else {
+		newLayer.LayerConfig.Created = e.now()
+	}
+
+	// the layer.tar of a replaced layer is empty, see RebuildImage
+	newID, err := e.newLayerID(newLayer, emptyLayerDigest())
+	if err != nil {
+		return err
+	}
 	newLayer.LayerConfig.ID = newID
 
 	cmd := strings.Join(orig.LayerConfig.ContainerConfig().Cmd, " ")
@@ -59,13 +83,16 @@ func (e *Export) ReplaceLayer(orig *Layer) error {
 		cmd = cmd[:60]
 	}
 
-	debugf("  -  Replacing %s w/ new layer %s (%s)\n", oldID[:12], newID[:12], cmd)
-	if child != nil {
-		e.Layers[child.LayerConfig.ID].LayerConfig.Parent = newID
+	e.debugf("  -  Replacing %s w/ new layer %s (%s)\n", truncateID(oldID), truncateID(newID), cmd)
+	for _, child := range children {
+		child.LayerConfig.Parent = newID
+		e.graph.setParent(child.LayerConfig.ID, newID)
 	}
 
 	e.Layers[newID] = newLayer
 	delete(e.Layers, oldID)
+	e.graph.remove(oldID)
+	e.graph.add(newID, newLayer.LayerConfig.Parent)
 
 	return nil
 }
@@ -6,59 +6,116 @@ import (
 )
 
 func (e *Export) firstLayer(pattern string) *Layer {
-	root := e.Root()
-	for {
-		if root == nil {
-			break
-		}
-		cmd := strings.Join(root.LayerConfig.ContainerConfig().Cmd, " ")
+	for _, layer := range e.chain() {
+		cmd := strings.Join(layer.LayerConfig.ContainerConfig().Cmd, " ")
 		if strings.Contains(cmd, pattern) {
-			break
+			return layer
 		}
-		root = e.ChildOf(root.LayerConfig.ID)
 	}
-	return root
+	return nil
 }
 
 // FirstSquash finds the first layer marked with the token #(squash)
 func (e *Export) FirstSquash() *Layer {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
 	return e.firstLayer("#(squash)")
 }
 
-// Root returns the top layer in the export
+// Root returns the top layer in the export. If there are several, the one
+// with the smallest ID is returned
 func (e *Export) Root() *Layer {
-	return e.ChildOf("")
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.childOf("")
 }
 
 // Last returns the layer found last in the list
 func (e *Export) Last() *Layer {
-	current := e.Root()
-	for {
-		if current == nil {
-			break
-		}
-		child := e.ChildOf(current.LayerConfig.ID)
-		if child == nil {
-			break
-		}
-		current = child
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.last()
+}
+
+func (e *Export) last() *Layer {
+	chain := e.chain()
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain[len(chain)-1]
+}
+
+// Chain returns the layers in order, from Root to Last
+func (e *Export) Chain() []*Layer {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.chain()
+}
+
+func (e *Export) chain() []*Layer {
+	return e.chainFrom("")
+}
+
+// chainFrom returns the layers in order, from layer id to Last
+func (e *Export) chainFrom(id string) []*Layer {
+	ids := e.graph.Chain(id)
+	ret := make([]*Layer, 0, len(ids))
+	for _, id := range ids {
+		ret = append(ret, e.Layers[id])
 	}
-	return current
+	return ret
 }
 
-// ChildOf returns the child layer or nil of the parent
+// ChildOf returns the child layer or nil of the parent. If the parent has
+// several children, the one with the smallest ID is returned
 func (e *Export) ChildOf(parent string) *Layer {
-	for _, entry := range e.Layers {
-		if entry.LayerConfig.Parent == parent {
-			return entry
-		}
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.childOf(parent)
+}
+
+func (e *Export) childOf(parent string) *Layer {
+	children := e.graph.children[parent]
+	if len(children) == 0 {
+		return nil
 	}
-	return nil
+	return e.Layers[children[0]]
+}
+
+// ChildrenOf returns all child layers of the parent, sorted by ID
+func (e *Export) ChildrenOf(parent string) []*Layer {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.childrenOf(parent)
+}
+
+func (e *Export) childrenOf(parent string) []*Layer {
+	children := e.graph.children[parent]
+	ret := make([]*Layer, 0, len(children))
+	for _, id := range children {
+		ret = append(ret, e.Layers[id])
+	}
+	return ret
+}
+
+// ParentOf returns the parent layer of the child, or nil if it is a root layer
+// or its parent is missing
+func (e *Export) ParentOf(child string) *Layer {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	parent, ok := e.graph.Parent(child)
+	if !ok || parent == "" {
+		return nil
+	}
+	return e.Layers[parent]
 }
 
 // GetByID returns an exportedImaged with a prefix matching ID.  An error
 // is returned multiple exportedImages matched.
 func (e *Export) GetByID(idPrefix string) (*Layer, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
 	matches := []*Layer{}
 	for id, entry := range e.Layers {
 		if strings.HasPrefix(id, idPrefix) {
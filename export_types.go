@@ -1,36 +1,69 @@
 package libsquash
 
+import (
+	"archive/tar"
+	"sync"
+	"time"
+
+	"github.com/winchman/libsquash/tarball"
+)
+
 type tagInfo map[string]string
 
 // An Export contains the layers of the image as well as various forms of
 // metadata.  An export "ingests" this metadata and then uses it to determine
-// how to compose the squashed image
+// how to compose the squashed image.
+//
+// The methods of an Export are safe for concurrent use. Each squash should use
+// its own Export
 type Export struct {
 	Layers       map[string]*Layer
 	Repositories map[string]*tagInfo
 	fileToLayers map[string][]fileLoc
-	layerToFiles map[string]map[string]bool
+	layerOffsets map[string]int64 // offset of the contents of each layer.tar in the image tarball
+	graph        *LayerGraph
 	start        *Layer
-	whiteouts    []whiteoutFile
+	order        map[string]int // position of each layer in the chain from start
+	tree         *fsTree        // the merged filesystem of the layers from start
+	options      Options
+	warnings     []Warning
+	storageUsage StorageUsage
+	sourceDate   time.Time // see resolveSourceDate
+
+	permissionChanges []PermissionChange
+	dedupStats        DedupStats
+	sparse            map[fileLoc][]tarball.SparseEntry // data regions of the sparse files
+	sparseStats       SparseStats
+
+	// lock guards all of the above. Exported methods take it; unexported
+	// methods expect it to be held
+	lock sync.RWMutex
 }
 
 type fileLoc struct {
 	uuid     string
-	whiteout bool // to indicate that the file as presented in this layer is a whiteout instead of a regular file
+	whiteout bool        // to indicate that the file as presented in this layer is a whiteout instead of a regular file
+	header   *tar.Header // the header of the file in the layer.tar
+	offset   int64       // the offset of the contents of the file in the layer.tar
+	index    int         // the position of the entry in the layer.tar; of several entries for a path, the last one wins
 }
 
-type whiteoutFile struct {
-	uuid   string // the layer in which the whiteout was found
-	prefix string // the file name prefix (without the ".wh." part)
+// NewExport returns a fully initialized *Export using the default Options
+func NewExport() *Export {
+	return NewExportWithOptions(Options{})
 }
 
-// NewExport returns a fully initialized *Export
-func NewExport() *Export {
+// NewExportWithOptions returns a fully initialized *Export that ingests and
+// squashes according to opts
+func NewExportWithOptions(opts Options) *Export {
 	return &Export{
 		Layers:       map[string]*Layer{},
 		Repositories: map[string]*tagInfo{},
 		fileToLayers: map[string][]fileLoc{},
-		layerToFiles: map[string]map[string]bool{},
-		whiteouts:    []whiteoutFile{},
+		layerOffsets: map[string]int64{},
+		order:        map[string]int{},
+		sparse:       map[fileLoc][]tarball.SparseEntry{},
+		graph:        newLayerGraph(nil),
+		options:      opts,
 	}
 }
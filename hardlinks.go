@@ -0,0 +1,75 @@
+package libsquash
+
+import (
+	"archive/tar"
+)
+
+/*
+Hard links in a layer.tar refer to another file of the same layer.tar by name
+(the Linkname), which comes before the link. Once the layers are merged, that
+can break in a few ways:
+
+1. the target is replaced or deleted by a later layer, so the link would end up
+pointing at other contents, or at nothing
+
+2. the link is written before its target, since the squash layer is written in
+tree order (see squashFiles)
+
+mergeLayers therefore resolves each hard link to the entry with the contents
+it refers to, and resolveHardLinks groups the files of the squash layer by
+that entry. The first file of a group to be written gets the contents, and the
+rest are written as hard links to it
+*/
+
+// hardLinkGroup is a set of names in the squash layer for the same contents
+type hardLinkGroup struct {
+	content fileLoc // the entry with the contents, never a hard link itself
+	written string  // the name the contents were written under, once written
+}
+
+// hardLinks is the result of resolveHardLinks
+type hardLinks struct {
+	members map[fileLoc]*hardLinkGroup
+}
+
+// resolveHardLinks groups files (see squashFiles) by the contents they refer
+// to
+func (e *Export) resolveHardLinks(files []squashFile) *hardLinks {
+	links := &hardLinks{members: map[fileLoc]*hardLinkGroup{}}
+	groups := map[fileLoc]*hardLinkGroup{}
+	for _, file := range files {
+		if file.loc != file.content && groups[file.content] == nil {
+			groups[file.content] = &hardLinkGroup{content: file.content}
+		}
+	}
+
+	// the targets that are still in the squash layer are part of their group
+	for _, file := range files {
+		if group, ok := groups[file.content]; ok {
+			links.members[file.loc] = group
+		}
+	}
+	return links
+}
+
+// entry returns the header to write for file. It is a copy, so it can be
+// modified
+func (l *hardLinks) entry(file squashFile) *tar.Header {
+	group, ok := l.members[file.loc]
+	if !ok {
+		header := *file.loc.header
+		header.Name = file.name
+		return &header
+	}
+
+	linked := *group.content.header
+	linked.Name = file.name
+	if group.written == "" {
+		group.written = linked.Name
+		return &linked
+	}
+	linked.Typeflag = tar.TypeLink
+	linked.Linkname = group.written
+	linked.Size = 0
+	return &linked
+}
@@ -0,0 +1,112 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+// describeEntry describes a file of a layer.tar for comparison in tests
+func describeEntry(file testImageFile) string {
+	switch file.header.Typeflag {
+	case tar.TypeReg:
+		return "file " + string(file.data)
+	case tar.TypeLink:
+		return "link " + file.header.Linkname
+	case tar.TypeSymlink:
+		return "symlink " + file.header.Linkname
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeChar:
+		return "char"
+	}
+	return "type " + string(file.header.Typeflag)
+}
+
+func TestSquashHardLinks(t *testing.T) {
+	device := testEntry{header: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}}
+	tests := []struct {
+		name   string
+		layers [][]testEntry
+		opts   Options
+		want   map[string]string // by name, "" if the file must not be written
+	}{
+		{
+			name: "target overwritten",
+			layers: [][]testEntry{
+				{testDir("etc/"), testFile("etc/hosts", "old"), testLink("etc/hosts.bak", "etc/hosts")},
+				{testFile("etc/hosts", "new")},
+			},
+			want: map[string]string{"etc/hosts": "file new", "etc/hosts.bak": "file old"},
+		},
+		{
+			name: "target deleted",
+			layers: [][]testEntry{
+				{testDir("bin/"), testFile("bin/a", "x"), testLink("bin/b", "bin/a")},
+				{testFile("bin/.wh.a", "")},
+			},
+			want: map[string]string{"bin/a": "", "bin/b": "file x"},
+		},
+		{
+			name: "link before its target",
+			layers: [][]testEntry{
+				{testDir("z/"), testFile("z/target", "t"), testDir("a/"), testLink("a/link", "z/target")},
+				{testFile("other", "o")},
+			},
+			want: map[string]string{"a/link": "file t", "z/target": "link a/link"},
+		},
+		{
+			name: "link in a later layer",
+			layers: [][]testEntry{
+				{testDir("bin/"), testFile("bin/a", "x")},
+				{testFile("bin/a", "y"), testLink("bin/b", "bin/a")},
+			},
+			want: map[string]string{"bin/a": "file y", "bin/b": "link bin/a"},
+		},
+		{
+			name: "dropped device",
+			layers: [][]testEntry{
+				{testDir("dev/"), device, testLink("dev/a-null", "dev/null"), testLink("dev/null2", "dev/null")},
+				{testFile("other", "o")},
+			},
+			opts: Options{Permissions: PermissionPolicy{Devices: DevicesDrop}},
+			want: map[string]string{"dev/": "dir", "dev/a-null": "", "dev/null": "", "dev/null2": "", "other": "file o"},
+		},
+		{
+			name: "kept device",
+			layers: [][]testEntry{
+				{testDir("dev/"), device, testLink("dev/a-null", "dev/null")},
+				{testFile("other", "o")},
+			},
+			want: map[string]string{"dev/a-null": "char", "dev/null": "link dev/a-null"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layers := make([]testLayer, len(test.layers))
+			for i, entries := range test.layers {
+				layers[i] = testLayer{cmd: "true", entries: entries}
+			}
+			out, _ := testSquash(t, testImage(t, layers...), test.opts)
+			files, _ := readTestImage(t, squashLayerTar(t, out))
+			for name, want := range test.want {
+				file, ok := files[name]
+				switch {
+				case !ok && want != "":
+					t.Errorf("%s: missing, want %q", name, want)
+				case ok && want == "":
+					t.Errorf("%s: got %q, want no file", name, describeEntry(file))
+				case ok && describeEntry(file) != want:
+					t.Errorf("%s: got %q, want %q", name, describeEntry(file), want)
+				}
+			}
+			for name, file := range files {
+				if file.header.Typeflag != tar.TypeLink {
+					continue
+				}
+				if target, ok := files[file.header.Linkname]; !ok || target.header.Typeflag == tar.TypeLink {
+					t.Errorf("%s: links to %s, which is not written before it as a file", name, file.header.Linkname)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"strconv"
+	"strings"
+)
+
+// IDRange maps the Size ids starting at ID to the ones starting at MapTo, like
+// a line of /proc/<pid>/uid_map
+type IDRange struct {
+	ID    int
+	MapTo int
+	Size  int
+}
+
+/*
+IDMapping changes the owners of the files in the squash layer, e.g. for user
+namespaced or rootless deployments:
+
+	libsquash.IDMapping{
+		UIDs: []libsquash.IDRange{{ID: 0, MapTo: 100000, Size: 65536}},
+		GIDs: []libsquash.IDRange{{ID: 0, MapTo: 100000, Size: 65536}},
+	}
+
+Ids are mapped by the first range that contains them, and ids outside of every
+range are left as they are. Users and Groups rename user and group names
+(Uname and Gname); names that are not in them are left as they are.
+
+The user in the Config of each layer from the squash point on, which all get
+new ids, is mapped as well: a numeric user or group by UIDs and GIDs, and a
+named one by Users and Groups
+*/
+type IDMapping struct {
+	UIDs   []IDRange
+	GIDs   []IDRange
+	Users  map[string]string
+	Groups map[string]string
+}
+
+func mapID(id int, ranges []IDRange) int {
+	for _, r := range ranges {
+		if id >= r.ID && id < r.ID+r.Size {
+			return r.MapTo + id - r.ID
+		}
+	}
+	return id
+}
+
+func mapName(name string, names map[string]string) string {
+	if mapped, ok := names[name]; ok {
+		return mapped
+	}
+	return name
+}
+
+// apply maps the owner of header in place. A nil m maps nothing
+func (m *IDMapping) apply(header *tar.Header) {
+	if m == nil {
+		return
+	}
+	header.Uid = mapID(header.Uid, m.UIDs)
+	header.Gid = mapID(header.Gid, m.GIDs)
+	if header.Uname != "" {
+		header.Uname = mapName(header.Uname, m.Users)
+	}
+	if header.Gname != "" {
+		header.Gname = mapName(header.Gname, m.Groups)
+	}
+}
+
+// mapUser maps a Config.User of the form user[:group]
+func (m *IDMapping) mapUser(user string) string {
+	if m == nil || user == "" {
+		return user
+	}
+	parts := strings.SplitN(user, ":", 2)
+	parts[0] = mapUserPart(parts[0], m.UIDs, m.Users)
+	if len(parts) == 2 {
+		parts[1] = mapUserPart(parts[1], m.GIDs, m.Groups)
+	}
+	return strings.Join(parts, ":")
+}
+
+func mapUserPart(part string, ranges []IDRange, names map[string]string) string {
+	if id, err := strconv.Atoi(part); err == nil {
+		return strconv.Itoa(mapID(id, ranges))
+	}
+	return mapName(part, names)
+}
+
+// mapConfigUsers maps the user in the Config of each layer from the squash
+// point on, which all get new ids. The Config may be shared between layers (see
+// insertLayer), so each is mapped once
+func (e *Export) mapConfigUsers(from *Layer) {
+	if e.options.IDMap == nil {
+		return
+	}
+	mapped := map[*Config]bool{}
+	for _, layer := range e.chainFrom(from.LayerConfig.ID) {
+		config := layer.LayerConfig.Config
+		if config == nil || mapped[config] {
+			continue
+		}
+		mapped[config] = true
+		config.User = e.options.IDMap.mapUser(config.User)
+	}
+}
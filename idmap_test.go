@@ -0,0 +1,93 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"strings"
+	"testing"
+)
+
+func TestIDMapping(t *testing.T) {
+	m := &IDMapping{
+		UIDs:   []IDRange{{ID: 0, MapTo: 100000, Size: 1000}, {ID: 0, MapTo: 1, Size: 65536}, {ID: 1000, MapTo: 2000, Size: 1}},
+		GIDs:   []IDRange{{ID: 0, MapTo: 200000, Size: 65536}},
+		Users:  map[string]string{"root": "nobody"},
+		Groups: map[string]string{"root": "nogroup"},
+	}
+	headers := []struct {
+		in, want tar.Header
+	}{
+		{tar.Header{Uid: 0, Gid: 0, Uname: "root", Gname: "root"}, tar.Header{Uid: 100000, Gid: 200000, Uname: "nobody", Gname: "nogroup"}},
+		{tar.Header{Uid: 999, Gid: 65535}, tar.Header{Uid: 100999, Gid: 265535}},
+		{tar.Header{Uid: 1000, Gid: 65536, Uname: "app", Gname: "app"}, tar.Header{Uid: 1001, Gid: 65536, Uname: "app", Gname: "app"}},
+		{tar.Header{Uid: 70000, Gid: 70000}, tar.Header{Uid: 70000, Gid: 70000}},
+	}
+	for _, test := range headers {
+		header := test.in
+		m.apply(&header)
+		if header.Uid != test.want.Uid || header.Gid != test.want.Gid || header.Uname != test.want.Uname || header.Gname != test.want.Gname {
+			t.Errorf("%d:%d %s:%s: got %d:%d %s:%s", test.in.Uid, test.in.Gid, test.in.Uname, test.in.Gname, header.Uid, header.Gid, header.Uname, header.Gname)
+		}
+	}
+
+	users := map[string]string{
+		"":          "",
+		"0":         "100000",
+		"0:0":       "100000:200000",
+		"root":      "nobody",
+		"root:root": "nobody:nogroup",
+		"app:0":     "app:200000",
+		"70000":     "70000",
+	}
+	for user, want := range users {
+		if got := m.mapUser(user); got != want {
+			t.Errorf("%q: got %q, want %q", user, got, want)
+		}
+	}
+
+	var none *IDMapping
+	header := tar.Header{Uid: 1, Uname: "root"}
+	none.apply(&header)
+	if header.Uid != 1 || header.Uname != "root" || none.mapUser("root") != "root" {
+		t.Error("a nil IDMapping changed the owner")
+	}
+}
+
+func TestIDMapChangesLayerIDs(t *testing.T) {
+	img := testImage(t,
+		testLayer{cmd: "#(nop) ADD file:root in /", user: "1000", entries: []testEntry{testDir("etc/"), testFile("etc/passwd", "root")}},
+		testLayer{cmd: "#(nop) ENV A=b", user: "1000"},
+	)
+	idMap := &IDMapping{UIDs: []IDRange{{ID: 0, MapTo: 100000, Size: 65536}}}
+
+	// the ids and users of the layers of the squashed image, by command
+	squash := func(idMap *IDMapping) (ids, users map[string]string) {
+		out, _ := testSquash(t, img, Options{Reproducible: true, IDMap: idMap})
+		ids, users = map[string]string{}, map[string]string{}
+		for id, config := range testLayerConfigs(t, out) {
+			cmd := strings.Join(config.ContainerConfig().Cmd, " ")
+			ids[cmd], users[cmd] = id, config.Config.User
+		}
+		return
+	}
+	plainIDs, plainUsers := squash(nil)
+	mappedIDs, mappedUsers := squash(idMap)
+	againIDs, _ := squash(idMap)
+
+	if len(plainIDs) != 3 {
+		t.Fatalf("got layers %v, want the rewritten layers and the squash layer", plainIDs)
+	}
+	for cmd, id := range plainIDs {
+		if plainUsers[cmd] != "1000" {
+			t.Errorf("%q: got user %q without IDMap, want 1000", cmd, plainUsers[cmd])
+		}
+		if mappedUsers[cmd] != "101000" {
+			t.Errorf("%q: got user %q with IDMap, want 101000", cmd, mappedUsers[cmd])
+		}
+		if mappedIDs[cmd] == id {
+			t.Errorf("%q: got the same id %s with and without IDMap", cmd, id)
+		}
+		if againIDs[cmd] != mappedIDs[cmd] {
+			t.Errorf("%q: got ids %s and %s for the same squash", cmd, mappedIDs[cmd], againIDs[cmd])
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package libsquash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// emptyLayerTar is the layer.tar written for the layers other than the squash
+// layer: an empty tarball, i.e. two 512 byte blocks of zeroes
+var emptyLayerTar = make([]byte, 1024)
+
+/*
+IDStrategy chooses the ids of the layers that a squash creates: the squash
+layer and the layers after it, which are rewritten (see RewriteChildren).
+
+The layers are given ids parents first, so parent is the final id of the
+parent layer. config is the json of the layer without its id, and
+contentDigest is the hex sha256 digest of its layer.tar. The id must be 64 hex
+characters that do not parse as a number when truncated to 12 characters
+*/
+type IDStrategy interface {
+	LayerID(parent string, config []byte, contentDigest string) (string, error)
+}
+
+// RandomIDs returns an IDStrategy that gives every layer a new random id.
+// This is the default
+func RandomIDs() IDStrategy {
+	return randomIDs{}
+}
+
+type randomIDs struct{}
+
+func (randomIDs) LayerID(parent string, config []byte, contentDigest string) (string, error) {
+	return newID()
+}
+
+/*
+ChainIDs returns an IDStrategy that derives the id of a layer from its parent
+id, its config and its contents, like the chain ids of the docker daemon. So
+squashing the same image the same way gives the same ids, and the layers can be
+reused from caches and registries.
+
+The Created time is left out of the config that is hashed, since it is the
+time of the squash unless Options.Reproducible is set. So the ids are stable in
+either mode, even though the json of the layers is only the same in
+reproducible mode
+*/
+func ChainIDs() IDStrategy {
+	return chainIDs{}
+}
+
+type chainIDs struct{}
+
+func (chainIDs) LayerID(parent string, config []byte, contentDigest string) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(config, &fields); err == nil {
+		delete(fields, "created")
+		// the keys of a map are marshalled sorted, so this is deterministic
+		if config, err = json.Marshal(fields); err != nil {
+			return "", err
+		}
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n", parent, contentDigest)
+	hash.Write(config)
+	id := hex.EncodeToString(hash.Sum(nil))
+
+	// like newID, avoid ids that look numeric when truncated
+	for isNumeric(truncateID(id)) {
+		sum := sha256.Sum256([]byte(id))
+		id = hex.EncodeToString(sum[:])
+	}
+	return id, nil
+}
+
+// newLayerID returns the id for layer, whose layer.tar has the sha256 digest
+// contentDigest, using the configured IDStrategy
+func (e *Export) newLayerID(layer *Layer, contentDigest string) (string, error) {
+	config := *layer.LayerConfig
+	config.ID = ""
+	configJSON, err := json.Marshal(&config)
+	if err != nil {
+		return "", err
+	}
+	return e.options.ids().LayerID(config.Parent, configJSON, contentDigest)
+}
+
+// emptyLayerDigest is the digest of emptyLayerTar
+func emptyLayerDigest() string {
+	sum := sha256.Sum256(emptyLayerTar)
+	return hex.EncodeToString(sum[:])
+}
+
+// setLayerID changes the id of layer to id, rewiring its children
+func (e *Export) setLayerID(layer *Layer, id string) {
+	oldID := layer.LayerConfig.ID
+	for _, child := range e.childrenOf(oldID) {
+		child.LayerConfig.Parent = id
+		e.graph.setParent(child.LayerConfig.ID, id)
+	}
+	delete(e.Layers, oldID)
+	e.graph.remove(oldID)
+
+	layer.LayerConfig.ID = id
+	e.Layers[id] = layer
+	e.graph.add(id, layer.LayerConfig.Parent)
+}
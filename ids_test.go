@@ -0,0 +1,149 @@
+package libsquash
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// checkLayerID fails t if id is not a valid layer id, see IDStrategy
+func checkLayerID(t *testing.T, id string) {
+	t.Helper()
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 64 {
+		t.Errorf("got id %q, want 64 hex characters", id)
+	}
+	if isNumeric(truncateID(id)) {
+		t.Errorf("got id %s, which is numeric when truncated", id)
+	}
+}
+
+func TestChainIDs(t *testing.T) {
+	type input struct {
+		parent, config, digest string
+	}
+	base := input{testLayerID(0), `{"created":"2015-01-01T00:00:00Z"}`, emptyLayerDigest()}
+	tests := []struct {
+		name  string
+		input input
+		same  bool
+	}{
+		{"same inputs", base, true},
+		{"other parent", input{testLayerID(1), base.config, base.digest}, false},
+		{"no parent", input{"", base.config, base.digest}, false},
+		{"other created", input{base.parent, `{"created":"2015-01-02T00:00:00Z"}`, base.digest}, true},
+		{"other config", input{base.parent, `{"created":"2015-01-01T00:00:00Z","author":"me"}`, base.digest}, false},
+		{"other contents", input{base.parent, base.config, fmt.Sprintf("%064x", 1)}, false},
+	}
+	ids := ChainIDs()
+	want, err := ids.LayerID(base.parent, []byte(base.config), base.digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLayerID(t, want)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ids.LayerID(test.input.parent, []byte(test.input.config), test.input.digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkLayerID(t, got)
+			if (got == want) != test.same {
+				t.Errorf("got id %s, base id %s", got, want)
+			}
+		})
+	}
+
+	// about 1 in 280 ids is numeric when truncated, and must be rehashed
+	for i := 0; i < 2000; i++ {
+		id, err := ids.LayerID(base.parent, []byte(fmt.Sprint(i)), base.digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLayerID(t, id)
+	}
+}
+
+func TestRandomIDs(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id, err := RandomIDs().LayerID("", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLayerID(t, id)
+		if seen[id] {
+			t.Fatalf("got id %s twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+// recordingIDs is an IDStrategy that records the parents it is called with,
+// and the ids it returns
+type recordingIDs struct {
+	parents []string
+	ids     []string
+}
+
+func (r *recordingIDs) LayerID(parent string, config []byte, contentDigest string) (string, error) {
+	id, err := ChainIDs().LayerID(parent, config, contentDigest)
+	r.parents = append(r.parents, parent)
+	r.ids = append(r.ids, id)
+	return id, err
+}
+
+func TestSquashIDs(t *testing.T) {
+	layers := func(contents string) []byte {
+		return testImage(t,
+			testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testDir("etc/")}},
+			testLayer{cmd: "make install", entries: []testEntry{testFile("etc/hosts", contents)}},
+			testLayer{cmd: "#(nop) ENV A=b"},
+		)
+	}
+	squash := func(img []byte, opts Options) string {
+		var out, idOut bytes.Buffer
+		if _, err := SquashWithOptions(bytes.NewReader(img), &out, &idOut, opts); err != nil {
+			t.Fatal(err)
+		}
+		return idOut.String()
+	}
+
+	img := layers("localhost")
+	first := squash(img, Options{Reproducible: true})
+	checkLayerID(t, first)
+	if again := squash(img, Options{Reproducible: true}); again != first {
+		t.Errorf("got ids %s and %s for the same reproducible squash", first, again)
+	}
+	if other := squash(layers("otherhost"), Options{Reproducible: true}); other == first {
+		t.Errorf("got id %s for different contents", other)
+	}
+	if random := squash(img, Options{Reproducible: true, IDs: RandomIDs()}); random == first {
+		t.Errorf("got id %s with RandomIDs", random)
+	}
+
+	// the ids do not depend on the time of the squash
+	chained := squash(img, Options{IDs: ChainIDs()})
+	checkLayerID(t, chained)
+	if again := squash(img, Options{IDs: ChainIDs()}); again != chained {
+		t.Errorf("got ids %s and %s for the same squash with ChainIDs", chained, again)
+	}
+
+	// each layer is given its id once its parent has its final one
+	recording := &recordingIDs{}
+	last := squash(img, Options{Reproducible: true, IDs: recording})
+	if last != first {
+		t.Errorf("got id %s through a custom IDStrategy, want %s", last, first)
+	}
+	if n := len(recording.ids); n < 4 || recording.ids[n-1] != last {
+		t.Fatalf("got ids %v, want the squash layer last", recording.ids)
+	}
+	// the first id is the placeholder of InsertLayer, see SquashLayers
+	given := map[string]bool{"": true}
+	for i, parent := range recording.parents[1:] {
+		if !given[parent] {
+			t.Errorf("got parent %s, which is not the id of a rewritten layer", parent)
+		}
+		given[recording.ids[i+1]] = true
+	}
+}
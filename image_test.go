@@ -0,0 +1,202 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEntry is an entry of a layer.tar built by testImage
+type testEntry struct {
+	header tar.Header
+	data   string
+}
+
+func testDir(name string) testEntry {
+	return testEntry{header: tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}}
+}
+
+func testFile(name, data string) testEntry {
+	return testEntry{header: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}, data: data}
+}
+
+func testSymlink(name, target string) testEntry {
+	return testEntry{header: tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}}
+}
+
+func testLink(name, target string) testEntry {
+	return testEntry{header: tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target, Mode: 0644}}
+}
+
+// testLayer is a layer of an image built by testImage
+type testLayer struct {
+	cmd     string
+	user    string
+	entries []testEntry
+	raw     []byte // the layer.tar, instead of one built from entries
+	root    bool   // the layer has no parent, even if it is not the first
+	json    []byte // the json, instead of one built from the fields above
+	noTar   bool   // the layer has no layer.tar
+}
+
+// testLayerID returns the id of the i-th layer of an image built by testImage
+func testLayerID(i int) string {
+	return fmt.Sprintf("%064x", 0xabc000+i)
+}
+
+// testLayerTar returns a layer.tar with entries. The size of regular files is
+// that of their data
+func testLayerTar(t *testing.T, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := entry.header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.data))
+		}
+		if header.ModTime.IsZero() {
+			header.ModTime = time.Unix(1000, 0)
+		}
+		if err := w.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testImage returns an image tarball, as written by `docker save`, with the
+// given layers from the root to the last layer
+func testImage(t *testing.T, layers ...testLayer) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	add := func(name string, data []byte) {
+		if err := w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, layer := range layers {
+		id := testLayerID(i)
+		config := map[string]interface{}{
+			"id":               id,
+			"created":          time.Unix(int64(2000+i), 0).UTC(),
+			"container_config": map[string]interface{}{"Cmd": []string{"/bin/sh", "-c", layer.cmd}},
+			"config":           map[string]interface{}{"User": layer.user},
+		}
+		if i > 0 && !layer.root {
+			config["parent"] = testLayerID(i - 1)
+		}
+		js, err := json.Marshal(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if layer.json != nil {
+			js = layer.json
+		}
+		if err := w.WriteHeader(&tar.Header{Name: id + "/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+		add(id+"/VERSION", []byte("1.0"))
+		add(id+"/json", js)
+		if layer.noTar {
+			continue
+		}
+		if layer.raw == nil {
+			layer.raw = testLayerTar(t, layer.entries)
+		}
+		add(id+"/layer.tar", layer.raw)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testSquash squashes img with opts and returns the squashed image tarball
+func testSquash(t *testing.T, img []byte, opts Options) ([]byte, *Report) {
+	var out, idOut bytes.Buffer
+	report, err := SquashWithOptions(bytes.NewReader(img), &out, &idOut, opts)
+	if err != nil {
+		t.Fatalf("squash: %v", err)
+	}
+	return out.Bytes(), report
+}
+
+// testImageFile is a file of an image tarball, see readTestImage
+type testImageFile struct {
+	header *tar.Header
+	data   []byte
+}
+
+// readTestImage returns the files of the tarball tarData, by name, and their
+// names in the order they are in the tarball
+func readTestImage(t *testing.T, tarData []byte) (map[string]testImageFile, []string) {
+	files := map[string]testImageFile{}
+	var names []string
+	r := tar.NewReader(bytes.NewReader(tarData))
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = testImageFile{header: header, data: data}
+		names = append(names, header.Name)
+	}
+	return files, names
+}
+
+// squashLayerTar returns the layer.tar of the squash layer of the squashed
+// image tarball img, the only one with a #(squash) command
+func squashLayerTar(t *testing.T, img []byte) []byte {
+	files, _ := readTestImage(t, img)
+	for name, file := range files {
+		if !strings.HasSuffix(name, "/json") || !bytes.Contains(file.data, []byte("#(squash)")) {
+			continue
+		}
+		layerTar, ok := files[strings.TrimSuffix(name, "json")+"layer.tar"]
+		if !ok {
+			t.Fatalf("no layer.tar for %s", name)
+		}
+		return layerTar.data
+	}
+	t.Fatal("no squash layer")
+	return nil
+}
+
+// testLayerConfigs returns the configs of the layers of the image tarball
+// img, by id
+func testLayerConfigs(t *testing.T, img []byte) map[string]*LayerConfig {
+	files, _ := readTestImage(t, img)
+	ret := map[string]*LayerConfig{}
+	for name, file := range files {
+		if !strings.HasSuffix(name, "/json") {
+			continue
+		}
+		config := &LayerConfig{}
+		if err := json.Unmarshal(file.data, config); err != nil {
+			t.Fatal(err)
+		}
+		ret[config.ID] = config
+	}
+	return ret
+}
@@ -3,7 +3,9 @@ package libsquash
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 
 	"github.com/winchman/libsquash/tarball"
 )
@@ -17,6 +19,10 @@ var (
 
 	// ErrorNoFROM is returned when o root layer can be found
 	ErrorNoFROM = errors.New("no root layer found")
+
+	// ErrorLayerCycle is returned when following the parents of a layer leads
+	// back to the layer itself
+	ErrorLayerCycle = errors.New("layers form a cycle")
 )
 
 /*
@@ -38,27 +44,52 @@ modify that file), we build a list like so:
 	file1: []layer
 	file2: []layer
 
+Files are keyed by their path from the root (see treePath), so that the
+different spellings of a name ("./etc/passwd", "etc/passwd", "etc/" and "etc")
+are the same file.
+
 After completing the processing of the tarball, this function calls
-another that translates the list as follows (note: a uuid is the unique
-identifier for a layer):
+another that replays the entries of the layers in order, the way they are
+extracted (see mergeLayers), which gives the files of the squash layer.
 
-	layerToFiles:
-	------------
-	uuid1: file1 -> true, file3 -> true
-	uuid2: file2 -> true
+The offset of each layer.tar within the tarball is recorded as well, so that
+SquashLayers can read the layer.tars directly if the tarball is seekable. In
+that case, IngestImageMetadata itself first walks the tarball without reading
+the layer.tars, and then reads them concurrently (see Options.Concurrency).
 
-The next time we we iterate over the image tarball, we only have one layer.tar
-at a time.  We need to know, based on the uuid of that layer.tar, which files
-to pull from it. That requires the layerToFiles structure.
+Errors are returned as an *Error recording the layer and tar entry that was
+being read when the failure occurred.
 */
 func (e *Export) IngestImageMetadata(tarstream io.Reader) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	source, base, seekableInput := seekable(tarstream)
+	var deferredLayerTars []string
+
+	// the last entry read, for the errors of the walk itself
+	var lastLayer, lastEntry string
+
 	if err := tarball.Walk(tarstream, func(t *tarball.TarFile) error {
+		lastLayer, lastEntry = "", t.Name()
+		if parts := t.NameParts(); len(parts) > 1 {
+			lastLayer = parts[0]
+		}
+		keep, w, err := sanitizeEntry(e.options.UnsafePaths, "", t.Header)
+		if w != nil {
+			e.warn(w.Kind, w.LayerID, w.Entry, w.Message)
+		}
+		if !keep {
+			return err
+		}
 		switch ParseType(t) {
 		case Ignore:
 			// ignore
+		case Unknown:
+			e.warn(WarningUnknownFile, "", t.Name(), "not part of any layer")
 		case Repositories:
 			if err := json.NewDecoder(t.Stream).Decode(&e.Repositories); err != nil {
-				return err
+				return e.tolerate(wrapError(PhaseIngest, "", t.Name(), err))
 			}
 			// Export may have multiple branches with the same parent; if so, abort.
 			for _, v := range e.Repositories {
@@ -67,100 +98,268 @@ func (e *Export) IngestImageMetadata(tarstream io.Reader) error {
 					commits[commit] = tag
 				}
 				if len(commits) > 1 {
-					return ErrorMultipleBranchesSameParent
+					return e.tolerate(wrapError(PhaseIngest, "", t.Name(), ErrorMultipleBranchesSameParent))
 				}
 			}
+		case Directory:
+			e.layer(t.NameParts()[0]).DirHeader = t.Header
+		case Version:
+			e.layer(t.NameParts()[0]).VersionHeader = t.Header
 		case JSON:
 			uuid := t.NameParts()[0]
-			if e.Layers[uuid] == nil {
-				e.Layers[uuid] = &Layer{}
+			layer := e.layer(uuid)
+			layer.JSONHeader = t.Header
+			if err := json.NewDecoder(t.Stream).Decode(&layer.LayerConfig); err != nil {
+				layer.LayerConfig = nil
+				return e.tolerate(wrapError(PhaseIngest, uuid, t.Name(), err))
 			}
-			e.Layers[uuid].JSONHeader = t.Header
-			if err := json.NewDecoder(t.Stream).Decode(&e.Layers[uuid].LayerConfig); err != nil {
-				return err
+			// the ids name the directories of the layers in the output
+			if config := layer.LayerConfig; !validLayerID(config.ID) || (config.Parent != "" && !validLayerID(config.Parent)) {
+				layer.LayerConfig = nil
+				return e.tolerate(wrapError(PhaseIngest, uuid, t.Name(), ErrorUnsafeLayerID))
 			}
 		case LayerTar:
 			uuid := t.NameParts()[0]
-			if e.Layers[uuid] == nil {
-				e.Layers[uuid] = &Layer{}
-			}
-			if err := tarball.Walk(t.Stream, func(tf *tarball.TarFile) error {
-				filePath := nameWithoutWhiteoutPrefix(tf.Name())
-				if e.fileToLayers[filePath] == nil {
-					e.fileToLayers[filePath] = []fileLoc{}
-				}
-				foundWhiteout := isWhiteout(tf.Name())
-				e.fileToLayers[filePath] = append(e.fileToLayers[filePath], fileLoc{
-					uuid:     uuid,
-					whiteout: foundWhiteout,
-				})
-
-				if foundWhiteout {
-					e.whiteouts = append(e.whiteouts, whiteoutFile{
-						prefix: filePath,
-						uuid:   uuid,
-					})
-				}
+			e.layer(uuid).LayerTarHeader = t.Header
+			e.layerOffsets[uuid] = t.Offset
+			if seekableInput {
+				deferredLayerTars = append(deferredLayerTars, uuid)
 				return nil
-			}); err != nil {
-				return err
 			}
+			layer, err := ingestLayerTar(uuid, t.Stream, e.options.UnsafePaths)
+			if err != nil {
+				return wrapError(PhaseIngest, uuid, t.Name(), err)
+			}
+			e.addIngestedLayer(layer)
 		}
 		return nil
 	}); err != nil {
+		return wrapError(PhaseIngest, lastLayer, lastEntry, err)
+	}
+
+	if seekableInput {
+		if err := e.ingestLayerTars(source, base, deferredLayerTars); err != nil {
+			return err
+		}
+	}
+
+	if err := e.checkLayers(); err != nil {
 		return err
 	}
 
-	return e.populateFileData()
+	if err := e.populateFileData(); err != nil {
+		return err
+	}
+
+	return wrapError(PhaseIngest, "", "", e.resolveSourceDate())
+}
+
+// ingestedLayer is what is learned from reading a single layer.tar. It is
+// built without touching the Export, so that layer.tars can be read
+// concurrently, and then added to the Export by addIngestedLayer
+type ingestedLayer struct {
+	uuid     string
+	files    []ingestedFile
+	warnings []Warning
 }
 
-// populateFileData populates the layerToFiles as described above
+type ingestedFile struct {
+	path   string
+	loc    fileLoc
+	sparse []tarball.SparseEntry // the data regions, for a sparse file
+}
+
+// ingestLayerTar notes which filesystem files are present or deleted in the
+// layer.tar of layer uuid. Entries with unsafe names are handled according to
+// policy
+func ingestLayerTar(uuid string, layerTar io.Reader, policy PathPolicy) (*ingestedLayer, error) {
+	layer := &ingestedLayer{uuid: uuid}
+	index := -1
+	err := tarball.Walk(layerTar, func(tf *tarball.TarFile) error {
+		index++
+		keep, w, err := sanitizeEntry(policy, uuid, tf.Header)
+		if w != nil {
+			layer.warnings = append(layer.warnings, *w)
+		}
+		if !keep {
+			return err
+		}
+		// the same file may be spelled differently by different layers
+		// (e.g. "./etc/" and "etc"), so files are keyed by tree path
+		filePath := nameWithoutWhiteoutPrefix(treePath(tf.Name()))
+		foundWhiteout := isWhiteout(treePath(tf.Name()))
+		file := ingestedFile{
+			path: filePath,
+			loc: fileLoc{
+				uuid:     uuid,
+				whiteout: foundWhiteout,
+				header:   tf.Header,
+				offset:   tf.Offset,
+				index:    index,
+			},
+		}
+
+		// the contents of a sparse file are not stored contiguously, so they
+		// are scanned now to find the data (see stageSparseFiles)
+		if tarball.IsSparse(tf.Header) {
+			sparse, err := tarball.ScanSparse(tf.Stream, tf.Header.Size)
+			if err != nil {
+				return wrapError(PhaseIngest, uuid, tf.Name(), err)
+			}
+			file.sparse = sparse
+		}
+		layer.files = append(layer.files, file)
+		return nil
+	})
+	return layer, err
+}
+
+// addIngestedLayer adds the files of layer to fileToLayers
+func (e *Export) addIngestedLayer(layer *ingestedLayer) {
+	for _, w := range layer.warnings {
+		e.warn(w.Kind, w.LayerID, w.Entry, w.Message)
+	}
+	for _, file := range layer.files {
+		e.fileToLayers[file.path] = append(e.fileToLayers[file.path], file.loc)
+		if file.sparse != nil {
+			e.sparse[file.loc] = file.sparse
+		}
+	}
+}
+
+// ingestLayerTars reads the layer.tars of the given layers from source on a
+// bounded number of goroutines. The results are added in the order of uuids,
+// so the outcome is the same as reading them sequentially
+func (e *Export) ingestLayerTars(source io.ReaderAt, base int64, uuids []string) error {
+	layerTars := make([]*io.SectionReader, len(uuids))
+	for i, uuid := range uuids {
+		layerTars[i] = io.NewSectionReader(source, base+e.layerOffsets[uuid], e.Layers[uuid].LayerTarHeader.Size)
+	}
+
+	layers := make([]*ingestedLayer, len(uuids))
+	if err := parallelize(len(uuids), e.options.concurrency(), func(i int) error {
+		layer, err := ingestLayerTar(uuids[i], layerTars[i], e.options.UnsafePaths)
+		if err != nil {
+			return wrapError(PhaseIngest, uuids[i], uuids[i]+"/layer.tar", err)
+		}
+		layers[i] = layer
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		e.addIngestedLayer(layer)
+	}
+	return nil
+}
+
+// layer returns the layer with the given uuid, adding an empty one if this is
+// the first time it has been seen
+func (e *Export) layer(uuid string) *Layer {
+	if e.Layers[uuid] == nil {
+		e.Layers[uuid] = &Layer{}
+	}
+	return e.Layers[uuid]
+}
+
+/*
+checkLayers records warnings for layers that cannot be squashed as expected:
+
+1. layers without a (decodable) json cannot be placed in the chain, so they
+are dropped
+
+2. layers without a layer.tar contribute no files
+
+3. layers that are not reachable from the root layer are orphans, so they are
+dropped as well and their files are ignored by populateFileData. This includes
+layers whose parent is missing and layers in a cycle. A cycle is an ingest
+error, as is a layer with multiple children or more than one root layer (only
+the first child or root is followed)
+*/
+func (e *Export) checkLayers() error {
+	for uuid, layer := range e.Layers {
+		if layer.LayerConfig == nil {
+			e.warn(WarningOrphanLayer, uuid, "", "layer has no json, ignoring it")
+			delete(e.Layers, uuid)
+			continue
+		}
+		if layer.LayerTarHeader == nil {
+			e.warn(WarningMissingLayerTar, uuid, "", "layer has json but no layer.tar")
+		}
+	}
+	e.reindex()
+	graph := e.graph
+
+	for _, cycle := range graph.Cycles() {
+		shortIDs := make([]string, len(cycle))
+		for i, id := range cycle {
+			shortIDs[i] = truncateID(id)
+		}
+		if err := e.tolerate(wrapError(PhaseIngest, cycle[0], "", fmt.Errorf("%w: %s", ErrorLayerCycle, strings.Join(shortIDs, " -> ")))); err != nil {
+			return err
+		}
+	}
+	for _, id := range graph.Branches() {
+		if err := e.tolerate(wrapError(PhaseIngest, id, "", ErrorMultipleBranchesSameParent)); err != nil {
+			return err
+		}
+	}
+	// the roots are the children of "", which Branches leaves out
+	if roots := graph.Roots(); len(roots) > 1 {
+		if err := e.tolerate(wrapError(PhaseIngest, roots[1], "", ErrorMultipleBranchesSameParent)); err != nil {
+			return err
+		}
+	}
+
+	reachable := map[string]bool{}
+	for _, id := range graph.Chain("") {
+		reachable[id] = true
+	}
+	missingParent := map[string]bool{}
+	for _, id := range graph.MissingParents() {
+		missingParent[id] = true
+	}
+	for uuid, layer := range e.Layers {
+		if reachable[uuid] {
+			continue
+		}
+		if missingParent[uuid] {
+			e.warn(WarningOrphanLayer, uuid, "", fmt.Sprintf("parent %s of layer is missing, ignoring it", truncateID(layer.LayerConfig.Parent)))
+		} else {
+			e.warn(WarningOrphanLayer, uuid, "", "layer is not in the chain from the root layer, ignoring it")
+		}
+		delete(e.Layers, uuid)
+		graph.remove(uuid)
+	}
+	return nil
+}
+
+// populateFileData merges the layers from the squash point on (see
+// mergeLayers) into e.tree
 func (e *Export) populateFileData() error {
-	e.start = e.FirstSquash()
+	e.start = e.firstLayer("#(squash)")
 
 	// Can't find a previously squashed layer, default to root
 	if e.start == nil {
-		e.start = e.Root()
+		e.start = e.childOf("")
 	}
 
 	if e.start == nil {
-		return ErrorNoFROM
+		return wrapError(PhaseIngest, "", "", ErrorNoFROM)
 	}
 
-	index := 0
-	current := e.start
 	orderMap := map[string]int{}
-	for {
-		orderMap[current.LayerConfig.ID] = index
-		index++
-		current = e.ChildOf(current.LayerConfig.ID)
-		if current == nil {
-			break
-		}
+	for index, layer := range e.chainFrom(e.start.LayerConfig.ID) {
+		orderMap[layer.LayerConfig.ID] = index
 	}
+	e.order = orderMap
 
-	for path, fileLocs := range e.fileToLayers {
-		if len(fileLocs) > 0 {
-			greatest := fileLocs[0]
-			for _, loc := range fileLocs {
-				if orderMap[loc.uuid] > orderMap[greatest.uuid] {
-					greatest = loc
-				}
-			}
-			if e.layerToFiles[greatest.uuid] == nil {
-				e.layerToFiles[greatest.uuid] = map[string]bool{}
-			}
-
-			// if name matches whiteout prefix and the whiteout file is found
-			// in a layer that is >= greatest.uuid, skip
-			uuidContainingWhiteout, matches := matchesWhiteout(path, e.whiteouts)
-			if (matches && orderMap[uuidContainingWhiteout] >= orderMap[greatest.uuid]) || greatest.whiteout {
-				delete(e.layerToFiles[greatest.uuid], path)
-			} else {
-				e.layerToFiles[greatest.uuid][path] = true
-			}
-		}
+	tree, err := e.mergeLayers()
+	if err != nil {
+		return err
 	}
+	e.tree = tree
 
 	return nil
 }
@@ -0,0 +1,102 @@
+package libsquash
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// ImageInfo describes the structure of an image, see Inspect
+type ImageInfo struct {
+	// Layers are the layers of the image, from the root to the last layer
+	Layers []LayerInfo
+
+	// Config is the effective config of the image, that of the last layer. It
+	// is shared with the Export it was taken from
+	Config *Config
+}
+
+// LayerInfo describes a layer of an image
+type LayerInfo struct {
+	ID      string
+	Parent  string
+	Created time.Time
+	Command string // the full command the layer was created by
+	Comment string
+
+	// Size is the size of the layer.tar, which is not compressed
+	Size int64
+
+	// ContentSize is the total size of the files in the layer.tar
+	ContentSize int64
+
+	// Files is the number of entries in the layer.tar that are not whiteouts
+	Files int
+
+	// Whiteouts is the number of whiteouts in the layer.tar
+	Whiteouts int
+
+	// ChangesFilesystem is whether the layer.tar has any entries. Layers
+	// without entries only change the config (e.g. ENV or "#(nop)" layers)
+	ChangesFilesystem bool
+}
+
+/*
+Inspect reads the image tarball from instream and describes its structure,
+without squashing it. The image is read once, as by IngestImageMetadata, so
+the Options that apply to ingest (Lenient, UnsafePaths and Concurrency) apply
+here as well
+*/
+func Inspect(instream io.Reader, opts Options) (*ImageInfo, error) {
+	export := NewExportWithOptions(opts)
+	if err := export.IngestImageMetadata(instream); err != nil {
+		return nil, err
+	}
+	return export.Inspect(), nil
+}
+
+// Inspect describes the structure of the image ingested by e (see
+// IngestImageMetadata)
+func (e *Export) Inspect() *ImageInfo {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	counts := map[string]*LayerInfo{}
+	for _, locs := range e.fileToLayers {
+		for _, loc := range locs {
+			info := counts[loc.uuid]
+			if info == nil {
+				info = &LayerInfo{}
+				counts[loc.uuid] = info
+			}
+			if loc.whiteout {
+				info.Whiteouts++
+			} else {
+				info.Files++
+				info.ContentSize += loc.header.Size
+			}
+		}
+	}
+
+	ret := &ImageInfo{Layers: []LayerInfo{}}
+	for _, layer := range e.chain() {
+		config := layer.LayerConfig
+		info := LayerInfo{
+			ID:      config.ID,
+			Parent:  config.Parent,
+			Created: config.Created,
+			Command: strings.Join(config.ContainerConfig().Cmd, " "),
+			Comment: config.Comment,
+		}
+		if layer.LayerTarHeader != nil {
+			info.Size = layer.LayerTarHeader.Size
+		}
+		if count := counts[config.ID]; count != nil {
+			info.ContentSize, info.Files, info.Whiteouts = count.ContentSize, count.Files, count.Whiteouts
+		}
+		info.ChangesFilesystem = info.Files+info.Whiteouts > 0
+		ret.Layers = append(ret.Layers, info)
+		ret.Config = config.Config
+	}
+	return ret
+}
@@ -0,0 +1,69 @@
+package libsquash
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspect(t *testing.T) {
+	install := "apt-get update && apt-get install -y --no-install-recommends ca-certificates curl git"
+	layers := []testLayer{
+		{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testDir("etc/"), testFile("etc/passwd", "root"), testFile("etc/group", "wheel")}},
+		{cmd: install, entries: []testEntry{testFile("etc/hosts", "localhost"), testFile("etc/.wh.group", "")}},
+		{cmd: "#(nop) ENV A=b", user: "app"},
+	}
+	img := testImage(t, layers...)
+	files, _ := readTestImage(t, img)
+
+	info, err := Inspect(bytes.NewReader(img), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LayerInfo{
+		{Command: "/bin/sh -c #(nop) ADD file:root in /", ContentSize: 9, Files: 3, ChangesFilesystem: true},
+		{Command: "/bin/sh -c " + install, ContentSize: 9, Files: 1, Whiteouts: 1, ChangesFilesystem: true},
+		{Command: "/bin/sh -c #(nop) ENV A=b"},
+	}
+	if len(info.Layers) != len(want) {
+		t.Fatalf("got %d layers, want %d", len(info.Layers), len(want))
+	}
+	for i, got := range info.Layers {
+		want := want[i]
+		want.ID = testLayerID(i)
+		if i > 0 {
+			want.Parent = testLayerID(i - 1)
+		}
+		want.Created = time.Unix(int64(2000+i), 0).UTC()
+		want.Size = int64(len(files[want.ID+"/layer.tar"].data))
+		if !got.Created.Equal(want.Created) {
+			t.Errorf("layer %d: got created %v, want %v", i, got.Created, want.Created)
+		}
+		got.Created = want.Created
+		if got != want {
+			t.Errorf("layer %d: got %+v, want %+v", i, got, want)
+		}
+	}
+	if len(info.Layers[1].Command) <= 60 || !strings.HasSuffix(info.Layers[1].Command, " git") {
+		t.Errorf("got command %q, want it untruncated", info.Layers[1].Command)
+	}
+	if info.Config == nil || info.Config.User != "app" {
+		t.Errorf("got config %+v, want that of the last layer", info.Config)
+	}
+
+	// the same, from an Export that ingested the image as a stream
+	export := NewExport()
+	if err := export.IngestImageMetadata(bytes.NewBuffer(img)); err != nil {
+		t.Fatal(err)
+	}
+	again := export.Inspect()
+	for i := range again.Layers {
+		if again.Layers[i] != info.Layers[i] {
+			t.Errorf("layer %d: got %+v from Export.Inspect, want %+v", i, again.Layers[i], info.Layers[i])
+		}
+	}
+	if again.Config != export.Last().LayerConfig.Config {
+		t.Error("got a config that is not that of the last layer of the Export")
+	}
+}
@@ -0,0 +1,254 @@
+package libsquash
+
+import (
+	"sort"
+)
+
+/*
+LayerGraph indexes the parent/child relationships between the layers of an
+Export in both directions, so that following the chain of layers does not
+require scanning every layer. Children are kept sorted by ID, so when a layer
+has more than one child (a branch), the chain deterministically follows the
+first one.
+
+The root layers are the children of the empty ID "".
+*/
+type LayerGraph struct {
+	parents  map[string]string   // child id -> parent id
+	children map[string][]string // parent id -> sorted child ids
+}
+
+// newLayerGraph indexes layers. Layers without a LayerConfig are left out
+func newLayerGraph(layers map[string]*Layer) *LayerGraph {
+	g := &LayerGraph{
+		parents:  map[string]string{},
+		children: map[string][]string{},
+	}
+	for id, layer := range layers {
+		if layer.LayerConfig != nil {
+			g.add(id, layer.LayerConfig.Parent)
+		}
+	}
+	return g
+}
+
+// Graph returns a snapshot of the index of the layers of e. The index is kept
+// up to date by IngestImageMetadata, InsertLayer and ReplaceLayer; if e.Layers
+// is modified directly, call Reindex
+func (e *Export) Graph() *LayerGraph {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.graph.clone()
+}
+
+// Reindex rebuilds the index of the layers of e from e.Layers
+func (e *Export) Reindex() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.reindex()
+}
+
+func (e *Export) reindex() {
+	e.graph = newLayerGraph(e.Layers)
+}
+
+func (g *LayerGraph) clone() *LayerGraph {
+	ret := &LayerGraph{
+		parents:  map[string]string{},
+		children: map[string][]string{},
+	}
+	for id, parent := range g.parents {
+		ret.parents[id] = parent
+	}
+	for id, children := range g.children {
+		ret.children[id] = append([]string{}, children...)
+	}
+	return ret
+}
+
+func (g *LayerGraph) add(id, parent string) {
+	g.parents[id] = parent
+	siblings := append(g.children[parent], id)
+	sort.Strings(siblings)
+	g.children[parent] = siblings
+}
+
+func (g *LayerGraph) remove(id string) {
+	parent, ok := g.parents[id]
+	if !ok {
+		return
+	}
+	delete(g.parents, id)
+	siblings := g.children[parent]
+	for i, sibling := range siblings {
+		if sibling == id {
+			g.children[parent] = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(g.children[parent]) == 0 {
+		delete(g.children, parent)
+	}
+}
+
+func (g *LayerGraph) setParent(id, parent string) {
+	g.remove(id)
+	g.add(id, parent)
+}
+
+// Has returns whether a layer with the given id is in the graph
+func (g *LayerGraph) Has(id string) bool {
+	_, ok := g.parents[id]
+	return ok
+}
+
+// Parent returns the id of the parent of layer id ("" for a root layer) and
+// whether layer id is in the graph at all
+func (g *LayerGraph) Parent(id string) (string, bool) {
+	parent, ok := g.parents[id]
+	return parent, ok
+}
+
+// Children returns the ids of the children of layer id, sorted. Use "" to get
+// the root layers
+func (g *LayerGraph) Children(id string) []string {
+	return append([]string{}, g.children[id]...)
+}
+
+// Roots returns the ids of the layers without a parent, sorted
+func (g *LayerGraph) Roots() []string {
+	return g.Children("")
+}
+
+// Branches returns the ids of the layers with more than one child, sorted
+func (g *LayerGraph) Branches() []string {
+	ret := []string{}
+	for parent, children := range g.children {
+		if parent != "" && len(children) > 1 {
+			ret = append(ret, parent)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// MissingParents returns the ids of the layers whose parent is not in the
+// graph, sorted
+func (g *LayerGraph) MissingParents() []string {
+	ret := []string{}
+	for id, parent := range g.parents {
+		if parent != "" && !g.Has(parent) {
+			ret = append(ret, id)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Cycles returns the loops in the graph (layers that are their own ancestor).
+// Each cycle starts at its smallest id and lists each layer's parent next
+func (g *LayerGraph) Cycles() [][]string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	ret := [][]string{}
+
+	ids := make([]string, 0, len(g.parents))
+	for id := range g.parents {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		path := []string{}
+		current := id
+		for g.Has(current) && state[current] == unvisited {
+			state[current] = visiting
+			path = append(path, current)
+			current = g.parents[current]
+		}
+		if state[current] == visiting {
+			// current is on this path, so the path from it on is a cycle
+			for i, member := range path {
+				if member == current {
+					ret = append(ret, rotateToSmallest(path[i:]))
+					break
+				}
+			}
+		}
+		for _, member := range path {
+			state[member] = done
+		}
+	}
+	return ret
+}
+
+func rotateToSmallest(cycle []string) []string {
+	smallest := 0
+	for i, id := range cycle {
+		if id < cycle[smallest] {
+			smallest = i
+		}
+	}
+	return append(append([]string{}, cycle[smallest:]...), cycle[:smallest]...)
+}
+
+// Chain returns the ids from layer id down to the last layer, following the
+// first child at each branch. It stops before revisiting a layer, so it
+// terminates even if the graph has cycles. Use "" to start at the first root
+func (g *LayerGraph) Chain(id string) []string {
+	ret := []string{}
+	seen := map[string]bool{}
+	if id == "" {
+		roots := g.children[""]
+		if len(roots) == 0 {
+			return ret
+		}
+		id = roots[0]
+	}
+	for g.Has(id) && !seen[id] {
+		seen[id] = true
+		ret = append(ret, id)
+		children := g.children[id]
+		if len(children) == 0 {
+			break
+		}
+		id = children[0]
+	}
+	return ret
+}
+
+// Walk calls walkFunc for layer id and each of its descendants, depth first
+// with children in order. depth is 0 for layer id. Use "" to walk from every
+// root (the roots then have depth 0). Walking stops at the first error
+func (g *LayerGraph) Walk(id string, walkFunc func(id string, depth int) error) error {
+	seen := map[string]bool{}
+	var walk func(id string, depth int) error
+	walk = func(id string, depth int) error {
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+		if err := walkFunc(id, depth); err != nil {
+			return err
+		}
+		for _, child := range g.children[id] {
+			if err := walk(child, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if id != "" {
+		return walk(id, 0)
+	}
+	for _, root := range g.children[""] {
+		if err := walk(root, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
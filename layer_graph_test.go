@@ -0,0 +1,153 @@
+package libsquash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testGraph returns the graph of layers with the given parents, by id
+func testGraph(parents map[string]string) *LayerGraph {
+	layers := map[string]*Layer{}
+	for id, parent := range parents {
+		layers[id] = &Layer{LayerConfig: &LayerConfig{ID: id, Parent: parent}}
+	}
+	return newLayerGraph(layers)
+}
+
+func TestLayerGraph(t *testing.T) {
+	tests := []struct {
+		name     string
+		parents  map[string]string
+		cycles   [][]string
+		missing  []string
+		branches []string
+		chain    []string
+		walk     string // id@depth, in the order walked from ""
+	}{
+		{
+			name:     "chain",
+			parents:  map[string]string{"a": "", "b": "a", "c": "b"},
+			cycles:   [][]string{},
+			missing:  []string{},
+			branches: []string{},
+			chain:    []string{"a", "b", "c"},
+			walk:     "a@0 b@1 c@2",
+		},
+		{
+			name:     "branch",
+			parents:  map[string]string{"a": "", "c": "a", "b": "a", "d": "b"},
+			cycles:   [][]string{},
+			missing:  []string{},
+			branches: []string{"a"},
+			chain:    []string{"a", "b", "d"},
+			walk:     "a@0 b@1 d@2 c@1",
+		},
+		{
+			name:     "missing parent",
+			parents:  map[string]string{"a": "", "b": "a", "y": "x"},
+			cycles:   [][]string{},
+			missing:  []string{"y"},
+			branches: []string{},
+			chain:    []string{"a", "b"},
+			walk:     "a@0 b@1",
+		},
+		{
+			name:     "cycle",
+			parents:  map[string]string{"a": "", "b": "a", "d": "c", "c": "e", "e": "d"},
+			cycles:   [][]string{{"c", "e", "d"}},
+			missing:  []string{},
+			branches: []string{},
+			chain:    []string{"a", "b"},
+			walk:     "a@0 b@1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := testGraph(test.parents)
+			if got := g.Cycles(); !reflect.DeepEqual(got, test.cycles) {
+				t.Errorf("Cycles: got %v, want %v", got, test.cycles)
+			}
+			if got := g.MissingParents(); !reflect.DeepEqual(got, test.missing) {
+				t.Errorf("MissingParents: got %v, want %v", got, test.missing)
+			}
+			if got := g.Branches(); !reflect.DeepEqual(got, test.branches) {
+				t.Errorf("Branches: got %v, want %v", got, test.branches)
+			}
+			if got := g.Chain(""); !reflect.DeepEqual(got, test.chain) {
+				t.Errorf("Chain: got %v, want %v", got, test.chain)
+			}
+			var walked []string
+			if err := g.Walk("", func(id string, depth int) error {
+				walked = append(walked, fmt.Sprintf("%s@%d", id, depth))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(walked, " "); got != test.walk {
+				t.Errorf("Walk: got %q, want %q", got, test.walk)
+			}
+		})
+	}
+}
+
+func TestLayerGraphFromLayer(t *testing.T) {
+	g := testGraph(map[string]string{"a": "", "b": "a", "c": "b", "d": "c", "b2": "a"})
+	if got, want := g.Chain("b"), []string{"b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Chain from b: got %v, want %v", got, want)
+	}
+	if got := g.Chain("x"); len(got) != 0 {
+		t.Errorf("Chain from a missing layer: got %v", got)
+	}
+
+	// the cycle is followed once
+	cyclic := testGraph(map[string]string{"a": "c", "b": "a", "c": "b"})
+	if got, want := cyclic.Chain("a"), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Chain through a cycle: got %v, want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	var walked []string
+	err := g.Walk("b", func(id string, depth int) error {
+		walked = append(walked, fmt.Sprintf("%s@%d", id, depth))
+		if id == "c" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || strings.Join(walked, " ") != "b@0 c@1" {
+		t.Errorf("got %v after walking %v, want to stop at c", err, walked)
+	}
+}
+
+func TestMultipleRoots(t *testing.T) {
+	img := testImage(t,
+		testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testFile("a", "a")}},
+		testLayer{cmd: "make install", entries: []testEntry{testFile("b", "b")}},
+		testLayer{cmd: "#(nop) ADD file:other in /", root: true, entries: []testEntry{testFile("c", "c")}},
+	)
+
+	var out, idOut bytes.Buffer
+	_, err := SquashWithOptions(bytes.NewReader(img), &out, &idOut, Options{})
+	var squashErr *Error
+	if !errors.Is(err, ErrorMultipleBranchesSameParent) || !errors.As(err, &squashErr) || squashErr.LayerID != testLayerID(2) {
+		t.Errorf("got %v, want ErrorMultipleBranchesSameParent for the second root", err)
+	}
+
+	// in lenient mode, the chain follows the first root
+	out2, report := testSquash(t, img, Options{Lenient: true})
+	kinds := map[WarningKind]string{}
+	for _, w := range report.Warnings {
+		kinds[w.Kind] = w.LayerID
+	}
+	if kinds[WarningIngestError] != testLayerID(2) || kinds[WarningOrphanLayer] != testLayerID(2) {
+		t.Errorf("got warnings %v", report.Warnings)
+	}
+	files, _ := readTestImage(t, squashLayerTar(t, out2))
+	if _, ok := files["c"]; ok || len(files) != 2 {
+		t.Errorf("got files %v, want a and b", files)
+	}
+}
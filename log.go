@@ -5,18 +5,41 @@ import (
 	"os"
 )
 
-// Verbose will print out debugging info when set to true. Should be set
-// manually in code only for debugging purposes
+// Verbose will print out debugging info to stderr when set to true, for
+// squashes that have no Options.Logger. Should be set manually in code only for
+// debugging purposes
 var Verbose bool
 
-func debugf(format string, args ...interface{}) {
+// Logger receives the debugging output of a squash. A *log.Logger is a Logger
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type stderrLogger struct{}
+
+func (stderrLogger) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+
+// logger returns the logger for e, or nil if debugging output is off
+func (e *Export) logger() Logger {
+	if e.options.Logger != nil {
+		return e.options.Logger
+	}
 	if Verbose {
-		fmt.Fprintf(os.Stderr, fmt.Sprintf("%s", format), args...)
+		return stderrLogger{}
 	}
+	return nil
 }
 
-func debug(args ...interface{}) {
-	if Verbose {
-		fmt.Fprintln(os.Stderr, args...)
+func (e *Export) debugf(format string, args ...interface{}) {
+	if logger := e.logger(); logger != nil {
+		logger.Printf(format, args...)
+	}
+}
+
+func (e *Export) debug(args ...interface{}) {
+	if logger := e.logger(); logger != nil {
+		logger.Printf("%s", fmt.Sprintln(args...))
 	}
 }
@@ -0,0 +1,111 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"runtime"
+	"time"
+)
+
+// Options configures how an image is squashed. The zero value gives the
+// default behavior
+type Options struct {
+	// Lenient makes ingest continue past errors that still leave usable
+	// metadata behind (an undecodable "repositories" file, an export with
+	// multiple branches, an undecodable layer json or one with an invalid
+	// id) by recording them as warnings instead of aborting. By default
+	// (strict mode) any ingest error aborts the squash. Errors reading the
+	// image tarball itself are always fatal
+	Lenient bool
+
+	// Storage is where temporary data is spilled to during the squash. If
+	// nil, files in the default directory for temporary files are used
+	Storage Storage
+
+	// Logger receives debugging output. If nil, debugging output goes to
+	// stderr if Verbose is set, and nowhere otherwise
+	Logger Logger
+
+	// UnsafePaths is what is done with entries of the image tarball and of
+	// the layer.tars that could write outside of the directory they are
+	// extracted to (absolute names, ".." components, or names under a symlink
+	// that leads outside). By default they fail the squash, see PathPolicy
+	UnsafePaths PathPolicy
+
+	// Concurrency is the maximum number of layer.tars read at once while
+	// ingesting a seekable image (see Squash). If <= 0, the number of CPUs is
+	// used. A non-seekable image is always read sequentially. The result of a
+	// squash does not depend on Concurrency
+	Concurrency int
+
+	// Xattrs selects the extended attributes (including file capabilities,
+	// "security.capability") that are kept in the squash layer. The zero
+	// value keeps all of them
+	Xattrs XattrPolicy
+
+	// IDMap, if not nil, changes the owners of the files in the squash layer
+	// and the user in the config of the image
+	IDMap *IDMapping
+
+	// Permissions hardens the modes of the files in the squash layer and
+	// restricts device nodes, see PermissionPolicy
+	Permissions PermissionPolicy
+
+	// Reproducible makes the output depend only on the input and the options:
+	// entries are normalized and have their modification times clamped to
+	// SourceDate, new layers are created at SourceDate, and layer ids are
+	// derived from their contents (ChainIDs) unless IDs is set
+	Reproducible bool
+
+	// SourceDate is the timestamp used in reproducible mode. If zero, the
+	// SOURCE_DATE_EPOCH environment variable is used, and if that is not set
+	// either, the Created time of the last layer of the image
+	SourceDate time.Time
+
+	// IDs chooses the ids of the layers created by the squash. If nil,
+	// RandomIDs is used, or ChainIDs in reproducible mode
+	IDs IDStrategy
+
+	// Format limits the tar header formats of the squash layer and of the
+	// image tarball: a single format (e.g. tar.FormatUSTAR) or a union of
+	// them. An entry that cannot be written in any of them fails the squash
+	// with tarball.ErrorUnrepresentable (see tarball.NewTarstreamFormat). If
+	// zero, each header is written in the format archive/tar chooses for it.
+	// CompatibleFormat avoids PAX headers
+	Format tar.Format
+
+	// Dedup writes regular files whose contents and metadata are identical to
+	// those of a file before them in the squash layer as hard links to that
+	// file. Modification times may differ, and the links take that of the
+	// file. See Report.Dedup for the space saved
+	Dedup bool
+}
+
+// CompatibleFormat is the Format that most tar readers accept: USTAR, and GNU
+// for the entries USTAR cannot hold (e.g. long names), but never PAX. Extended
+// attributes can only be written in PAX, so use it with an XattrPolicy that
+// strips them
+const CompatibleFormat = tar.FormatUSTAR | tar.FormatGNU
+
+func (o Options) concurrency() int {
+	if o.Concurrency <= 0 {
+		return runtime.NumCPU()
+	}
+	return o.Concurrency
+}
+
+func (o Options) storage() Storage {
+	if o.Storage == nil {
+		return NewDirStorage("")
+	}
+	return o.Storage
+}
+
+func (o Options) ids() IDStrategy {
+	if o.IDs != nil {
+		return o.IDs
+	}
+	if o.Reproducible {
+		return ChainIDs()
+	}
+	return RandomIDs()
+}
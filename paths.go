@@ -0,0 +1,141 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrorUnsafePath is returned when an entry of the image tarball or of a
+	// layer.tar could write outside of the directory it is extracted to and
+	// Options.UnsafePaths is PathsReject, through one of the more specific
+	// errors below
+	ErrorUnsafePath = errors.New("unsafe path")
+
+	// ErrorAbsolutePath is for an entry (or hard link target) with an
+	// absolute name
+	ErrorAbsolutePath = fmt.Errorf("%w: absolute name", ErrorUnsafePath)
+
+	// ErrorPathTraversal is for an entry (or hard link target) whose ".."
+	// components lead above the root
+	ErrorPathTraversal = fmt.Errorf("%w: name leads outside of the root", ErrorUnsafePath)
+
+	// ErrorSymlinkEscape is for a file in a layer.tar that is written through
+	// a symlink, from a layer below, whose target is absolute or leads above
+	// the root
+	ErrorSymlinkEscape = fmt.Errorf("%w: name leads outside of the root through a symlink", ErrorUnsafePath)
+
+	// ErrorUnsafeLayerID is for a layer json whose id or parent is not 64 hex
+	// characters, so it could not safely be used as the name of a directory in
+	// the image tarball. Options.UnsafePaths does not apply to it: it is an
+	// ingest error, and in lenient mode (see Options.Lenient) the json is left
+	// out, so the layer is dropped with a warning
+	ErrorUnsafeLayerID = fmt.Errorf("%w: invalid layer id", ErrorUnsafePath)
+)
+
+// PathPolicy is what is done with the tar entries whose names are unsafe (see
+// ErrorUnsafePath)
+type PathPolicy int
+
+const (
+	// PathsReject fails the squash with one of the ErrorUnsafePath errors
+	PathsReject PathPolicy = iota
+
+	// PathsSanitize keeps the entry, with its name made relative to the root.
+	// ".." components stop at the root, and a symlink that leads above the
+	// root leads to the root, as they do in a container
+	PathsSanitize
+
+	// PathsDrop leaves the entry out
+	PathsDrop
+)
+
+// checkPath returns why name is unsafe, or nil if it is not
+func checkPath(name string) error {
+	if path.IsAbs(name) {
+		return ErrorAbsolutePath
+	}
+	depth := 0
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return ErrorPathTraversal
+			}
+		default:
+			depth++
+		}
+	}
+	return nil
+}
+
+// sanitizePath returns name relative to the root, keeping a trailing "/"
+func sanitizePath(name string) string {
+	ret := treePath(name)
+	if strings.HasSuffix(name, "/") && ret != "" {
+		ret += "/"
+	}
+	return ret
+}
+
+// validLayerID returns whether id is a layer id (64 lowercase hex characters),
+// so that it can be used as the name of a directory in the image tarball
+func validLayerID(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+applyPathPolicy handles an entry of layer uuid (or of the image tarball, if
+uuid is "") that is unsafe because of cause:
+
+1. PathsReject returns cause as an *Error
+
+2. PathsSanitize returns keep = true and a warning
+
+3. PathsDrop returns keep = false and a warning
+
+The caller records the warning and sanitizes the entry
+*/
+func applyPathPolicy(policy PathPolicy, uuid, name string, cause error) (keep bool, w *Warning, err error) {
+	switch policy {
+	case PathsSanitize:
+		return true, &Warning{Kind: WarningUnsafePath, LayerID: uuid, Entry: name, Message: cause.Error() + ", sanitizing it"}, nil
+	case PathsDrop:
+		return false, &Warning{Kind: WarningUnsafePath, LayerID: uuid, Entry: name, Message: cause.Error() + ", dropping it"}, nil
+	}
+	return false, nil, wrapError(PhaseIngest, uuid, name, cause)
+}
+
+// sanitizeEntry checks the name of header, and its link name for a hard
+// link, and handles them according to policy (see applyPathPolicy). If the
+// entry is kept, its names are sanitized in place
+func sanitizeEntry(policy PathPolicy, uuid string, header *tar.Header) (keep bool, w *Warning, err error) {
+	cause := checkPath(header.Name)
+	if cause == nil && header.Typeflag == tar.TypeLink {
+		if cause = checkPath(header.Linkname); cause != nil {
+			cause = fmt.Errorf("target %q of hard link: %w", header.Linkname, cause)
+		}
+	}
+	if cause == nil {
+		return true, nil, nil
+	}
+	if keep, w, err = applyPathPolicy(policy, uuid, header.Name, cause); keep {
+		header.Name = sanitizePath(header.Name)
+		if header.Typeflag == tar.TypeLink {
+			header.Linkname = sanitizePath(header.Linkname)
+		}
+	}
+	return keep, w, err
+}
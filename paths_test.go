@@ -0,0 +1,134 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeEntry(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   tar.Header
+		policy   PathPolicy
+		keep     bool
+		wantName string
+		wantLink string
+		err      error // nil if no error, or the error it must match
+		warning  bool
+	}{
+		{"safe", tar.Header{Name: "./etc/passwd"}, PathsReject, true, "./etc/passwd", "", nil, false},
+		{"inner dots", tar.Header{Name: "etc/../etc/passwd"}, PathsReject, true, "etc/../etc/passwd", "", nil, false},
+		{"absolute rejected", tar.Header{Name: "/etc/passwd"}, PathsReject, false, "/etc/passwd", "", ErrorAbsolutePath, false},
+		{"absolute sanitized", tar.Header{Name: "/etc/passwd"}, PathsSanitize, true, "etc/passwd", "", nil, true},
+		{"absolute dropped", tar.Header{Name: "/etc/passwd"}, PathsDrop, false, "/etc/passwd", "", nil, true},
+		{"traversal rejected", tar.Header{Name: "etc/../../x"}, PathsReject, false, "etc/../../x", "", ErrorPathTraversal, false},
+		{"traversal sanitized", tar.Header{Name: "../../etc/"}, PathsSanitize, true, "etc/", "", nil, true},
+		{"root sanitized", tar.Header{Name: "/"}, PathsSanitize, true, "", "", nil, true},
+		{"hard link rejected", tar.Header{Name: "x", Typeflag: tar.TypeLink, Linkname: "../etc/shadow"}, PathsReject, false, "x", "../etc/shadow", ErrorPathTraversal, false},
+		{"hard link sanitized", tar.Header{Name: "x", Typeflag: tar.TypeLink, Linkname: "/etc/shadow"}, PathsSanitize, true, "x", "etc/shadow", nil, true},
+		{"symlink target not checked", tar.Header{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "../../etc/shadow"}, PathsReject, true, "x", "../../etc/shadow", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := test.header
+			keep, w, err := sanitizeEntry(test.policy, "layer", &header)
+			if keep != test.keep {
+				t.Errorf("got keep %v, want %v", keep, test.keep)
+			}
+			if header.Name != test.wantName || header.Linkname != test.wantLink {
+				t.Errorf("got %q -> %q, want %q -> %q", header.Name, header.Linkname, test.wantName, test.wantLink)
+			}
+			switch {
+			case test.err == nil && err != nil:
+				t.Errorf("got %v, want no error", err)
+			case test.err != nil && !errors.Is(err, test.err):
+				t.Errorf("got %v, want %v", err, test.err)
+			case test.err != nil && !errors.Is(err, ErrorUnsafePath):
+				t.Errorf("got %v, want it to match ErrorUnsafePath", err)
+			}
+			if (w != nil) != test.warning {
+				t.Errorf("got warning %v", w)
+			}
+			if w != nil && (w.Kind != WarningUnsafePath || w.LayerID != "layer" || w.Entry != test.header.Name) {
+				t.Errorf("got warning %+v", w)
+			}
+		})
+	}
+}
+
+func TestValidLayerID(t *testing.T) {
+	for id, want := range map[string]bool{
+		testLayerID(0):                  true,
+		"":                              false,
+		".":                             false,
+		"..":                            false,
+		"../x":                          false,
+		`a\b`:                           false,
+		"abc":                           false,
+		testLayerID(0) + "0":            false,
+		strings.ToUpper(testLayerID(0)): false,
+		strings.Repeat("g", 64):         false,
+		"../" + testLayerID(0)[3:]:      false,
+	} {
+		if got := validLayerID(id); got != want {
+			t.Errorf("%q: got %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestSquashSymlinkEscape(t *testing.T) {
+	images := []struct {
+		name    string
+		link    testEntry // the symlink, in the first layer
+		entry   string    // the file written through it, in the second layer
+		written string    // where it is written when sanitized
+	}{
+		{"relative", testSymlink("up", "../.."), "up/etc/cron", "etc/cron"},
+		{"absolute", testSymlink("x", "/etc"), "x/evil", "etc/evil"},
+	}
+	for _, image := range images {
+		t.Run(image.name, func(t *testing.T) {
+			img := testImage(t,
+				testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testDir("etc/"), image.link}},
+				testLayer{cmd: "make install", entries: []testEntry{testFile(image.entry, "* * * * * evil")}},
+			)
+			link := "symlink " + image.link.header.Linkname
+			tests := []struct {
+				policy PathPolicy
+				want   map[string]string // by name, "" if the file must not be written
+			}{
+				{PathsSanitize, map[string]string{image.written: "file * * * * * evil", image.link.header.Name: link}},
+				{PathsDrop, map[string]string{image.written: "", image.link.header.Name: link}},
+			}
+			for _, test := range tests {
+				out, report := testSquash(t, img, Options{UnsafePaths: test.policy})
+				if len(report.Warnings) != 1 || report.Warnings[0].Kind != WarningUnsafePath || report.Warnings[0].Entry != image.entry {
+					t.Errorf("policy %d: got warnings %v", test.policy, report.Warnings)
+				}
+				files, _ := readTestImage(t, squashLayerTar(t, out))
+				for name, want := range test.want {
+					file, ok := files[name]
+					switch {
+					case !ok && want != "":
+						t.Errorf("policy %d: %s: missing, want %q", test.policy, name, want)
+					case ok && describeEntry(file) != want:
+						t.Errorf("policy %d: %s: got %q, want %q", test.policy, name, describeEntry(file), want)
+					}
+				}
+			}
+
+			var out, idOut bytes.Buffer
+			_, err := SquashWithOptions(bytes.NewReader(img), &out, &idOut, Options{})
+			var squashErr *Error
+			if !errors.Is(err, ErrorSymlinkEscape) || !errors.As(err, &squashErr) || squashErr.LayerID != testLayerID(1) || squashErr.Entry != image.entry {
+				t.Errorf("got %v, want ErrorSymlinkEscape for %s", err, image.entry)
+			}
+			if out.Len() != 0 || idOut.Len() != 0 {
+				t.Errorf("got %d bytes of output for a rejected image", out.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrorSpecialFileRejected is returned by SquashLayers when the squash
+	// layer would contain a device node or FIFO and Options.Permissions.Devices
+	// is DevicesReject
+	ErrorSpecialFileRejected = errors.New("device nodes and FIFOs are not allowed")
+)
+
+// DevicePolicy is what PermissionPolicy does with character and block devices
+// and FIFOs
+type DevicePolicy int
+
+const (
+	// DevicesKeep writes them as they are
+	DevicesKeep DevicePolicy = iota
+
+	// DevicesDrop leaves them out of the squash layer
+	DevicesDrop
+
+	// DevicesReject fails the squash with ErrorSpecialFileRejected
+	DevicesReject
+)
+
+/*
+PermissionPolicy hardens the files in the squash layer as they are written.
+The zero value changes nothing. For example, this removes setuid and setgid
+binaries, world-writable files and device nodes:
+
+	libsquash.PermissionPolicy{
+		ClearSpecialBits: true,
+		MaxMode:          0775,
+		Devices:          libsquash.DevicesDrop,
+	}
+
+Each change is reported as a PermissionChange
+*/
+type PermissionPolicy struct {
+	// ClearSpecialBits clears the setuid and setgid bits
+	ClearSpecialBits bool
+
+	// ClearStickyBit clears the sticky bit, except on directories that are
+	// still world-writable once MaxMode is applied (e.g. /tmp), which would
+	// then let anyone delete the files of others
+	ClearStickyBit bool
+
+	// MaxMode, if not 0, caps the permission bits (0777) of every file: the
+	// bits that are not set in MaxMode are cleared
+	MaxMode int64
+
+	// Devices is what is done with device nodes and FIFOs
+	Devices DevicePolicy
+}
+
+// PermissionChange is a change made to a file by the PermissionPolicy
+type PermissionChange struct {
+	Path    string
+	OldMode int64
+	NewMode int64 // same as OldMode if the file was dropped
+	Dropped bool
+}
+
+func (c PermissionChange) String() string {
+	if c.Dropped {
+		return fmt.Sprintf("%s: dropped (mode %o)", c.Path, c.OldMode)
+	}
+	return fmt.Sprintf("%s: mode %o -> %o", c.Path, c.OldMode, c.NewMode)
+}
+
+// PermissionChanges returns the changes made by the PermissionPolicy in
+// SquashLayers
+func (e *Export) PermissionChanges() []PermissionChange {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return append([]PermissionChange{}, e.permissionChanges...)
+}
+
+// isSpecialFile returns whether header is a device node or FIFO
+func isSpecialFile(header *tar.Header) bool {
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	}
+	return false
+}
+
+// allowSpecialFile applies the device policy to the file named name, with its
+// contents described by content (see hardLinks.entry). It returns whether the
+// file is to be written
+func (e *Export) allowSpecialFile(name string, content *tar.Header) (bool, error) {
+	if !isSpecialFile(content) {
+		return true, nil
+	}
+	switch e.options.Permissions.Devices {
+	case DevicesDrop:
+		e.permissionChanges = append(e.permissionChanges, PermissionChange{Path: name, OldMode: content.Mode, NewMode: content.Mode, Dropped: true})
+		return false, nil
+	case DevicesReject:
+		return false, ErrorSpecialFileRejected
+	}
+	return true, nil
+}
+
+// hardenMode applies the mode policy to header in place
+func (e *Export) hardenMode(header *tar.Header) {
+	policy := e.options.Permissions
+	if header.Typeflag == tar.TypeLink || header.Typeflag == tar.TypeSymlink {
+		// the mode of a hard link is that of its target, and that of a
+		// symlink is ignored
+		return
+	}
+	mode := header.Mode
+	if policy.ClearSpecialBits {
+		mode &^= 06000
+	}
+	if policy.MaxMode != 0 {
+		mode &^= 0777 &^ policy.MaxMode
+	}
+	if policy.ClearStickyBit && (header.Typeflag != tar.TypeDir || mode&0002 == 0) {
+		mode &^= 01000
+	}
+	if mode != header.Mode {
+		e.permissionChanges = append(e.permissionChanges, PermissionChange{Path: header.Name, OldMode: header.Mode, NewMode: mode})
+		header.Mode = mode
+	}
+}
@@ -0,0 +1,46 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestHardenMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   PermissionPolicy
+		typeflag byte
+		mode     int64
+		want     int64
+	}{
+		{"zero policy", PermissionPolicy{}, tar.TypeReg, 06755, 06755},
+		{"setuid", PermissionPolicy{ClearSpecialBits: true}, tar.TypeReg, 04755, 0755},
+		{"setgid directory", PermissionPolicy{ClearSpecialBits: true}, tar.TypeDir, 02775, 0775},
+		{"sticky kept", PermissionPolicy{ClearSpecialBits: true}, tar.TypeDir, 01777, 01777},
+		{"sticky kept with MaxMode", PermissionPolicy{ClearSpecialBits: true, MaxMode: 0777}, tar.TypeDir, 05777, 01777},
+		{"sticky cleared", PermissionPolicy{ClearStickyBit: true}, tar.TypeReg, 01755, 0755},
+		{"sticky cleared on directory", PermissionPolicy{ClearStickyBit: true}, tar.TypeDir, 01755, 0755},
+		{"sticky kept on world-writable directory", PermissionPolicy{ClearStickyBit: true}, tar.TypeDir, 01777, 01777},
+		{"sticky cleared once MaxMode applies", PermissionPolicy{ClearStickyBit: true, MaxMode: 0775}, tar.TypeDir, 01777, 0775},
+		{"MaxMode", PermissionPolicy{MaxMode: 0755}, tar.TypeReg, 0777, 0755},
+		{"MaxMode keeps special bits", PermissionPolicy{MaxMode: 0755}, tar.TypeReg, 04777, 04755},
+		{"symlink", PermissionPolicy{ClearSpecialBits: true, ClearStickyBit: true, MaxMode: 0755}, tar.TypeSymlink, 0777, 0777},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := NewExportWithOptions(Options{Permissions: test.policy})
+			header := &tar.Header{Name: "path", Typeflag: test.typeflag, Mode: test.mode}
+			e.hardenMode(header)
+			if header.Mode != test.want {
+				t.Errorf("got mode %o, want %o", header.Mode, test.want)
+			}
+			changes := e.PermissionChanges()
+			switch {
+			case test.mode == test.want && len(changes) != 0:
+				t.Errorf("got changes %v, want none", changes)
+			case test.mode != test.want && (len(changes) != 1 || changes[0].OldMode != test.mode || changes[0].NewMode != test.want):
+				t.Errorf("got changes %v, want %o -> %o", changes, test.mode, test.want)
+			}
+		})
+	}
+}
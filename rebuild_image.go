@@ -25,31 +25,44 @@ LayerConfig data), write the four rquired files
 		b. if it is any other layer, it will contain only 2x 512 byte blocks of \x00 (this is the way to represent an empty tarball)
 */
 func (e *Export) RebuildImage(squashLayer *Layer, outstream io.Writer, squashLayerFile *os.File) (imageID string, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	fi, err := squashLayerFile.Stat()
+	if err != nil {
+		return "", wrapError(PhaseRebuild, squashLayer.LayerConfig.ID, squashLayer.LayerConfig.ID+"/layer.tar", err)
+	}
+	return e.rebuildImage(squashLayer, outstream, squashLayerFile, fi.Size())
+}
+
+// rebuildImage is RebuildImage, with the layer.tar for the squash layer read
+// from squashLayerTar, which contains squashLayerTarSize bytes
+func (e *Export) rebuildImage(squashLayer *Layer, outstream io.Writer, squashLayerTar io.Reader, squashLayerTarSize int64) (imageID string, err error) {
 	var (
 		latestDirHeader, latestVersionHeader *tar.Header
 		latestJSONHeader, latestTarHeader    *tar.Header
 		retID                                string
 	)
 
-	tw := tarball.NewTarstream(outstream)
+	tw := tarball.NewTarstreamFormat(outstream, e.options.Format)
 	squashedLayerConfig := squashLayer.LayerConfig
-	current := e.Root()
-
-	for {
+	for _, current := range e.chain() {
 		// add "<uuid>/"
 		var dir *tar.Header
 		dir, latestDirHeader = chooseDefault(current.DirHeader, latestDirHeader)
 		dir.Name = current.LayerConfig.ID + "/"
+		e.normalizeHeader(dir)
 		if err := tw.Add(&tarball.TarFile{Header: dir}); err != nil {
-			return "", err
+			return "", wrapError(PhaseRebuild, current.LayerConfig.ID, dir.Name, err)
 		}
 
 		// add "<uuid>/VERSION"
 		var version *tar.Header
 		version, latestVersionHeader = chooseDefault(current.VersionHeader, latestVersionHeader)
 		version.Name = current.LayerConfig.ID + "/VERSION"
+		e.normalizeHeader(version)
 		if err := tw.Add(&tarball.TarFile{Header: version, Stream: bytes.NewBuffer([]byte("1.0"))}); err != nil {
-			return "", err
+			return "", wrapError(PhaseRebuild, current.LayerConfig.ID, version.Name, err)
 		}
 
 		// add "<uuid>/json"
@@ -58,53 +71,45 @@ func (e *Export) RebuildImage(squashLayer *Layer, outstream io.Writer, squashLay
 		var err error
 		jsonHdr, latestJSONHeader = chooseDefault(current.JSONHeader, latestJSONHeader)
 		jsonHdr.Name = current.LayerConfig.ID + "/json"
+		e.normalizeHeader(jsonHdr)
 		if current.LayerConfig.ID == squashLayer.LayerConfig.ID {
 			jsonBytes, err = json.Marshal(squashedLayerConfig)
 		} else {
 			jsonBytes, err = json.Marshal(current.LayerConfig)
 		}
 		if err != nil {
-			return "", err
+			return "", wrapError(PhaseRebuild, current.LayerConfig.ID, jsonHdr.Name, err)
 		}
 		jsonHdr.Size = int64(len(jsonBytes))
 		if err := tw.Add(&tarball.TarFile{Header: jsonHdr, Stream: bytes.NewBuffer(jsonBytes)}); err != nil {
-			return "", err
+			return "", wrapError(PhaseRebuild, current.LayerConfig.ID, jsonHdr.Name, err)
 		}
 
 		// add "<uuid>/layer.tar"
 		var layerTar *tar.Header
 		layerTar, latestTarHeader = chooseDefault(current.LayerTarHeader, latestTarHeader)
 		layerTar.Name = current.LayerConfig.ID + "/layer.tar"
+		e.normalizeHeader(layerTar)
 		if current.LayerConfig.ID == squashLayer.LayerConfig.ID {
-			fi, err := squashLayerFile.Stat()
-			if err != nil {
-				return "", err
-			}
-			layerTar.Size = fi.Size()
-			if err := tw.Add(&tarball.TarFile{Header: layerTar, Stream: squashLayerFile}); err != nil {
-				return "", err
+			layerTar.Size = squashLayerTarSize
+			if err := tw.Add(&tarball.TarFile{Header: layerTar, Stream: squashLayerTar}); err != nil {
+				return "", wrapError(PhaseRebuild, current.LayerConfig.ID, layerTar.Name, err)
 			}
 		} else {
-			layerTar.Size = 1024
+			layerTar.Size = int64(len(emptyLayerTar))
 			if err := tw.Add(
-				&tarball.TarFile{Header: layerTar, Stream: bytes.NewBuffer(bytes.Repeat([]byte("\x00"), 1024))},
+				&tarball.TarFile{Header: layerTar, Stream: bytes.NewReader(emptyLayerTar)},
 			); err != nil {
-				return "", err
+				return "", wrapError(PhaseRebuild, current.LayerConfig.ID, layerTar.Name, err)
 			}
 		}
 
-		// check loop condition
-		child := e.ChildOf(current.LayerConfig.ID)
-		if child == nil {
-			// return the ID of the last layer - it will be the image ID used by the daemon
-			retID = current.LayerConfig.ID
-			break
-		}
-		current = child
+		// the ID of the last layer will be the image ID used by the daemon
+		retID = current.LayerConfig.ID
 	}
 	// close tar writer before returning
 	if err := tw.Close(); err != nil {
-		return "", err
+		return "", wrapError(PhaseRebuild, "", "", err)
 	}
 	return retID, nil
 }
@@ -0,0 +1,24 @@
+package libsquash
+
+// Report describes the outcome of a squash
+type Report struct {
+	// ImageID is the id of the squashed image
+	ImageID string
+
+	// Warnings are the non-fatal diagnostics collected during the squash
+	Warnings []Warning
+
+	// StorageUsage is the space used in Options.Storage for spill data. All
+	// spills of a squash are held until the end of the squash, so this is also
+	// the peak usage
+	StorageUsage StorageUsage
+
+	// PermissionChanges are the changes made by Options.Permissions, by path
+	PermissionChanges []PermissionChange
+
+	// Dedup describes the files replaced by hard links by Options.Dedup
+	Dedup DedupStats
+
+	// Sparse describes the sparse files in the squash layer
+	Sparse SparseStats
+}
@@ -0,0 +1,94 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+resolveSourceDate sets the timestamp used in reproducible mode (see
+Options.Reproducible). It is, in order of preference:
+
+1. Options.SourceDate
+
+2. the SOURCE_DATE_EPOCH environment variable, in seconds since the Unix epoch
+
+3. the Created time of the last layer of the image
+*/
+func (e *Export) resolveSourceDate() error {
+	if !e.options.Reproducible {
+		return nil
+	}
+	switch epoch := os.Getenv("SOURCE_DATE_EPOCH"); {
+	case !e.options.SourceDate.IsZero():
+		e.sourceDate = e.options.SourceDate
+	case epoch != "":
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %v", epoch, err)
+		}
+		e.sourceDate = time.Unix(seconds, 0)
+	default:
+		if last := e.last(); last != nil {
+			e.sourceDate = last.LayerConfig.Created
+		}
+	}
+	e.sourceDate = e.sourceDate.UTC().Truncate(time.Second)
+	return nil
+}
+
+// now returns the Created time for new layers
+func (e *Export) now() time.Time {
+	if e.options.Reproducible {
+		return e.sourceDate
+	}
+	return time.Now().UTC()
+}
+
+// clampTime returns t, or the source date if t is later in reproducible mode
+func (e *Export) clampTime(t time.Time) time.Time {
+	if e.options.Reproducible && t.After(e.sourceDate) {
+		return e.sourceDate
+	}
+	return t
+}
+
+/*
+normalizeHeader makes header independent of how the layer.tar it came from was
+written, in reproducible mode. It does so in place:
+
+1. the modification time is clamped to the source date and truncated to
+seconds, and the access and change times are dropped
+
+2. the device numbers of files that are not devices are cleared
+
+3. the format is left for archive/tar to choose, based on the fields that are
+left, so that e.g. a file from a GNU tarball and the same file from a PAX
+tarball are written the same way
+*/
+func (e *Export) normalizeHeader(header *tar.Header) {
+	if !e.options.Reproducible {
+		return
+	}
+	header.ModTime = e.clampTime(header.ModTime).Truncate(time.Second)
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	if header.Typeflag != tar.TypeChar && header.Typeflag != tar.TypeBlock {
+		header.Devmajor, header.Devminor = 0, 0
+	}
+	if len(header.PAXRecords) > 0 {
+		records := map[string]string{}
+		for key, value := range header.PAXRecords {
+			switch key {
+			case "atime", "ctime", "mtime":
+			default:
+				records[key] = value
+			}
+		}
+		header.PAXRecords = records
+	}
+	header.Format = tar.FormatUnknown
+}
@@ -0,0 +1,123 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reproducibleTestImage returns an image whose layers are created at 2000,
+// 2001 and 2002 seconds since the epoch, with a file modified at 5000
+func reproducibleTestImage(t *testing.T) []byte {
+	future := testFile("etc/future", "f")
+	future.header.ModTime = time.Unix(5000, 0)
+	withTimes := testFile("etc/times", "t")
+	withTimes.header.ModTime = time.Unix(1500, 123456789)
+	withTimes.header.AccessTime = time.Unix(1600, 0)
+	withTimes.header.Format = tar.FormatPAX
+	return testImage(t,
+		testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testDir("etc/"), testFile("etc/passwd", "root")}},
+		testLayer{cmd: "make install", entries: []testEntry{future, withTimes}},
+		testLayer{cmd: "#(nop) ENV A=b"},
+	)
+}
+
+func TestReproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	img := reproducibleTestImage(t)
+	squash := func(input io.Reader, opts Options) []byte {
+		var out, idOut bytes.Buffer
+		if _, err := SquashWithOptions(input, &out, &idOut, opts); err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes()
+	}
+
+	first := squash(bytes.NewReader(img), Options{Reproducible: true})
+	if again := squash(bytes.NewReader(img), Options{Reproducible: true}); !bytes.Equal(again, first) {
+		t.Error("got different output for the same squash")
+	}
+	if stream := squash(io.MultiReader(bytes.NewReader(img)), Options{Reproducible: true}); !bytes.Equal(stream, first) {
+		t.Error("got different output for a stream and a seekable input")
+	}
+	if plain := squash(bytes.NewReader(img), Options{}); bytes.Equal(plain, first) {
+		t.Error("got the same output without Reproducible")
+	}
+
+	// the source date defaults to the Created time of the last layer
+	files, _ := readTestImage(t, squashLayerTar(t, first))
+	if got := files["etc/future"].header.ModTime; !got.Equal(time.Unix(2002, 0)) {
+		t.Errorf("got modification time %v, want it clamped to the last layer", got)
+	}
+	times := files["etc/times"].header
+	if !times.ModTime.Equal(time.Unix(1500, 0)) || !times.AccessTime.IsZero() {
+		t.Errorf("got times %v and %v, want the modification time truncated and no access time", times.ModTime, times.AccessTime)
+	}
+}
+
+func TestSourceDate(t *testing.T) {
+	img := reproducibleTestImage(t)
+	sourceDate := time.Unix(2001, 0).UTC()
+	tests := []struct {
+		name  string
+		opts  Options
+		epoch string
+	}{
+		{"SourceDate", Options{Reproducible: true, SourceDate: sourceDate}, ""},
+		{"SOURCE_DATE_EPOCH", Options{Reproducible: true}, "2001"},
+		{"SourceDate over SOURCE_DATE_EPOCH", Options{Reproducible: true, SourceDate: sourceDate}, "9999"},
+	}
+	var want []byte
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SOURCE_DATE_EPOCH", test.epoch)
+			out, _ := testSquash(t, img, test.opts)
+			if want == nil {
+				want = out
+			} else if !bytes.Equal(out, want) {
+				t.Error("got different output for the same source date")
+			}
+
+			files, _ := readTestImage(t, squashLayerTar(t, out))
+			mtimes := map[string]time.Time{
+				"etc/passwd": time.Unix(1000, 0),
+				"etc/future": sourceDate,
+			}
+			for name, mtime := range mtimes {
+				if got := files[name].header.ModTime; !got.Equal(mtime) {
+					t.Errorf("%s: got modification time %v, want %v", name, got, mtime)
+				}
+			}
+
+			// the layers that are later than the source date are clamped to it
+			created := map[string]time.Time{
+				"#(nop) ADD file:root in /": time.Unix(2000, 0),
+				"make install":              sourceDate,
+				"#(nop) ENV A=b":            sourceDate,
+			}
+			configs := testLayerConfigs(t, out)
+			if len(configs) != len(created)+1 {
+				t.Fatalf("got %d layers, want %d", len(configs), len(created)+1)
+			}
+			for _, config := range configs {
+				cmd := strings.TrimPrefix(strings.Join(config.ContainerConfig().Cmd, " "), "/bin/sh -c ")
+				want, ok := created[cmd]
+				if strings.HasPrefix(cmd, "#(squash)") {
+					want, ok = sourceDate, true
+				}
+				if !ok || !config.Created.Equal(want) {
+					t.Errorf("%q: got created %v, want %v", cmd, config.Created, want)
+				}
+			}
+		})
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "soon")
+	var out, idOut bytes.Buffer
+	if _, err := SquashWithOptions(bytes.NewReader(img), &out, &idOut, Options{Reproducible: true}); err == nil {
+		t.Error("got no error for an invalid SOURCE_DATE_EPOCH")
+	}
+}
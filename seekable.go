@@ -0,0 +1,48 @@
+package libsquash
+
+import (
+	"io"
+	"sync"
+)
+
+/*
+seekable returns a random access view of r and the current position of r, if
+r supports it. That is the case for an io.ReadSeeker (such as an *os.File or a
+*bytes.Reader) that can actually seek; an *os.File for a pipe (such as
+os.Stdin fed by "docker save") implements io.Seeker but fails to seek, so it is
+not seekable
+*/
+func seekable(r io.Reader) (source io.ReaderAt, base int64, ok bool) {
+	seeker, ok := r.(io.ReadSeeker)
+	if !ok {
+		return nil, 0, false
+	}
+	base, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, false
+	}
+	if readerAt, ok := r.(io.ReaderAt); ok {
+		return readerAt, base, true
+	}
+	return &readSeekerAt{seeker: seeker}, base, true
+}
+
+// readSeekerAt adapts an io.ReadSeeker into an io.ReaderAt. Concurrent reads
+// are serialized
+type readSeekerAt struct {
+	seeker io.ReadSeeker
+	lock   sync.Mutex
+}
+
+func (r *readSeekerAt) ReadAt(p []byte, off int64) (n int, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, err = r.seeker.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err = io.ReadFull(r.seeker, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
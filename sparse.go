@@ -0,0 +1,115 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"io"
+
+	"github.com/winchman/libsquash/tarball"
+)
+
+// SparseStats describes the sparse files written to the squash layer. If
+// Options.Format does not allow PAX, they are written in full and not counted
+type SparseStats struct {
+	// Files is the number of sparse files
+	Files int
+
+	// LogicalBytes is their total size, including holes
+	LogicalBytes int64
+
+	// StoredBytes is the total size of their data, i.e. without holes
+	StoredBytes int64
+}
+
+// SparseStats returns the sparse files written by SquashLayers
+func (e *Export) SparseStats() SparseStats {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.sparseStats
+}
+
+/*
+stageSparseFiles copies the data of the sparse files among files to a spill, so
+that they can be written as sparse files (see tarball.TarFile). The data of a
+sparse file is not stored contiguously in its layer.tar, so unlike other files
+it cannot be read from an offset; instead, each layer.tar with sparse files in
+the squash layer is read once more, and the data regions found by ingest (see
+tarball.ScanSparse) are copied.
+
+It returns the offset of the data of each sparse file in the spill, which is
+nil if there are no sparse files. The spill is released by the caller
+*/
+func (e *Export) stageSparseFiles(source io.ReaderAt, base int64, files []squashFile) (Spill, map[fileLoc]int64, error) {
+	needed := map[string]map[int64]fileLoc{} // by layer, then offset
+	for _, file := range files {
+		if _, ok := e.sparse[file.content]; !ok {
+			continue
+		}
+		if needed[file.content.uuid] == nil {
+			needed[file.content.uuid] = map[int64]fileLoc{}
+		}
+		needed[file.content.uuid][file.content.offset] = file.content
+	}
+	if len(needed) == 0 {
+		return nil, nil, nil
+	}
+
+	spill, err := e.createSpill()
+	if err != nil {
+		return nil, nil, err
+	}
+	offsets := map[fileLoc]int64{}
+	for _, layer := range e.chainFrom(e.start.LayerConfig.ID) {
+		uuid := layer.LayerConfig.ID
+		if needed[uuid] == nil {
+			continue
+		}
+		layerTar := io.NewSectionReader(source, base+e.layerOffsets[uuid], layer.LayerTarHeader.Size)
+		if err := tarball.Walk(layerTar, func(tf *tarball.TarFile) error {
+			loc, ok := needed[uuid][tf.Offset]
+			if !ok {
+				return nil
+			}
+			offsets[loc] = spill.Size()
+			return copySparseData(spill, tf.Stream, e.sparse[loc])
+		}); err != nil {
+			return spill, nil, wrapError(PhaseSquash, uuid, uuid+"/layer.tar", err)
+		}
+	}
+	return spill, offsets, nil
+}
+
+// copySparseData copies the data regions of the sparse file read from r to w
+func copySparseData(w io.Writer, r io.Reader, entries []tarball.SparseEntry) error {
+	var position int64
+	for _, entry := range entries {
+		if _, err := io.CopyN(io.Discard, r, entry.Offset-position); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, entry.Length); err != nil {
+			return err
+		}
+		position = entry.Offset + entry.Length
+	}
+	return nil
+}
+
+// sparseTarFile makes tf, for a file with the contents at content, a sparse
+// file whose data is read from staged at offset (see stageSparseFiles), and
+// counts it if it will be written as such. It does nothing if the file is not
+// sparse
+func (e *Export) sparseTarFile(tf *tarball.TarFile, content fileLoc, staged io.ReaderAt, offset int64) {
+	entries, ok := e.sparse[content]
+	if !ok || tf.Header.Typeflag == tar.TypeLink {
+		return
+	}
+	tf.Header.Typeflag = tar.TypeReg
+	tf.Sparse = entries
+	tf.Stream = io.NewSectionReader(staged, offset, tarball.StoredSize(entries))
+	if !tarball.WritesSparse(e.options.Format) {
+		return
+	}
+
+	e.sparseStats.Files++
+	e.sparseStats.LogicalBytes += tf.Header.Size
+	e.sparseStats.StoredBytes += tarball.StoredSize(entries)
+}
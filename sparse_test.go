@@ -0,0 +1,65 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/winchman/libsquash/tarball"
+)
+
+// sparseLayerTar returns a layer.tar with a sparse file "disk.img" of size
+// bytes, holding data at offset
+func sparseLayerTar(t *testing.T, size, offset int64, data string) []byte {
+	var buf bytes.Buffer
+	stream := tarball.NewTarstream(&buf)
+	header := &tar.Header{Name: "disk.img", Typeflag: tar.TypeReg, Mode: 0644, Size: size, ModTime: time.Unix(1000, 0)}
+	entries := []tarball.SparseEntry{{Offset: offset, Length: int64(len(data))}, {Offset: size, Length: 0}}
+	if err := stream.Add(&tarball.TarFile{Header: header, Stream: bytes.NewReader([]byte(data)), Sparse: entries}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSquashSparseFormat(t *testing.T) {
+	const size, offset = 4 << 20, 1 << 20
+	data := string(bytes.Repeat([]byte("data"), 128))
+	img := testImage(t,
+		testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testDir("etc/")}},
+		testLayer{cmd: "truncate -s 4M /disk.img", raw: sparseLayerTar(t, size, offset, data)},
+	)
+	want := make([]byte, size)
+	copy(want[offset:], data)
+
+	tests := []struct {
+		name   string
+		format tar.Format
+		sparse bool
+		stats  SparseStats
+	}{
+		{"any format", tar.FormatUnknown, true, SparseStats{Files: 1, LogicalBytes: size, StoredBytes: int64(len(data))}},
+		{"PAX", tar.FormatPAX, true, SparseStats{Files: 1, LogicalBytes: size, StoredBytes: int64(len(data))}},
+		{"USTAR", tar.FormatUSTAR, false, SparseStats{}},
+		{"compatible", CompatibleFormat, false, SparseStats{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, report := testSquash(t, img, Options{Format: test.format})
+			if report.Sparse != test.stats {
+				t.Errorf("got stats %+v, want %+v", report.Sparse, test.stats)
+			}
+			layerTar := squashLayerTar(t, out)
+			if stored := len(layerTar) < size; stored != test.sparse {
+				t.Errorf("got a layer.tar of %d bytes for a file of %d bytes", len(layerTar), size)
+			}
+			files, _ := readTestImage(t, layerTar)
+			if file := files["disk.img"]; !bytes.Equal(file.data, want) {
+				t.Errorf("got contents of %d bytes, not those of the sparse file", len(file.data))
+			}
+		})
+	}
+}
@@ -3,8 +3,6 @@ package libsquash
 import (
 	"errors"
 	"io"
-	"io/ioutil"
-	"os"
 	"strings"
 )
 
@@ -23,92 +21,121 @@ and imageIDOut is an io.Writer to which the id of the squashed image will be wri
 
 The steps are as follows:
 
-1. Go through stream, tee'ing it to a tempfile, get layer configs and layer->file lists
+1. Go through stream, tee'ing it to a spill (see Storage), get layer configs and layer->file lists
 
-2. Using the metadata, go through the tar stream again (from the tempfile),
+2. Using the metadata, go through the tar stream again (from the spill),
 build the squash layer, build the final image tar, and write it to our output stream
 
+If instream is seekable (an io.ReadSeeker such as an *os.File for a regular
+file), it is not copied to a spill. Instead, the second step reads each
+layer.tar directly from instream, at the offsets found during the first step
+
 3. (as a cleanup step, write the id of the final layer, which the daemon will
 use as the image id)
+
+Squash uses the default Options; see SquashWithOptions
 */
 func Squash(instream io.Reader, outstream io.Writer, imageIDOut io.Writer) error {
-	export := NewExport()
-	tempfile, err := ioutil.TempFile("", "libsquash")
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		_ = tempfile.Close()
-		_ = os.RemoveAll(tempfile.Name())
-	}()
+	_, err := SquashWithOptions(instream, outstream, imageIDOut, Options{})
+	return err
+}
 
-	instreamTee := io.TeeReader(instream, tempfile)
+/*
+SquashWithOptions squashes a docker image like Squash, configured by opts. On
+success, the returned Report contains the id of the squashed image and any
+warnings collected along the way
+*/
+func SquashWithOptions(instream io.Reader, outstream io.Writer, imageIDOut io.Writer, opts Options) (*Report, error) {
+	export := NewExportWithOptions(opts)
 
 	/*
 		1. Ingest Image Metadata: populate metadata from first stream
 	*/
-	export.IngestImageMetadata(instreamTee)
+	var tarstream io.Reader
+	var inputSpill Spill
+	if _, base, ok := seekable(instream); ok {
+		// the layer.tars will be read back directly from instream
+		if err := export.IngestImageMetadata(instream); err != nil {
+			return nil, err
+		}
+		if _, err := instream.(io.Seeker).Seek(base, io.SeekStart); err != nil {
+			return nil, wrapError(PhaseIngest, "", "", err)
+		}
+		tarstream = instream
+	} else {
+		spill, err := export.createSpill()
+		if err != nil {
+			return nil, wrapError(PhaseIngest, "", "", err)
+		}
+		defer export.releaseSpill(spill)
+
+		if err := export.IngestImageMetadata(io.TeeReader(instream, spill)); err != nil {
+			return nil, err
+		}
 
-	// rewind tempfile to the entire tar stream can be read back in
-	if _, err = tempfile.Seek(0, 0); err != nil {
-		return err
+		// the entire tar stream can be read back in from the spill
+		tarstream = io.NewSectionReader(spill, 0, spill.Size())
+		inputSpill = spill
 	}
 
 	last := export.Last()
 	if last == nil {
-		return ErrorNoLast
+		return nil, wrapError(PhaseSquash, "", "", ErrorNoLast)
 	}
 
 	// insert a new layer after our squash point
 	newEntry, err := export.InsertLayer(last.LayerConfig.ID)
 	if err != nil {
-		return err
+		return nil, wrapError(PhaseSquash, last.LayerConfig.ID, "", err)
 	}
 
-	// copy this so we don't lose important metadata like ENV vars and ENTRYPOINT
-	newEntry.LayerConfig.Config = last.LayerConfig.Config
+	export.debugf("Inserted new layer %s after %s\n", truncateID(newEntry.LayerConfig.ID), truncateID(newEntry.LayerConfig.Parent))
 
-	debugf("Inserted new layer %s after %s\n", newEntry.LayerConfig.ID[0:12], newEntry.LayerConfig.Parent[0:12])
-
-	if Verbose {
+	if export.logger() != nil {
 		printVerbose(export, newEntry.LayerConfig.ID)
 	}
 
 	/*
 		2. squash all later layers into our new layer (from second stream)
 	*/
-	imageID, err := export.SquashLayers(newEntry, export.start, tempfile, outstream)
+	imageID, err := export.SquashLayers(newEntry, export.start, tarstream, outstream)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	/*
 		3. write the imageID to the imageID output stream
 	*/
 	if _, err := imageIDOut.Write([]byte(imageID)); err != nil {
-		return err
+		return nil, wrapError(PhaseRebuild, imageID, "", err)
 	}
 
-	return nil
+	report := &Report{
+		ImageID:           imageID,
+		Warnings:          export.Warnings(),
+		StorageUsage:      export.StorageUsage(),
+		PermissionChanges: export.PermissionChanges(),
+		Dedup:             export.DedupStats(),
+		Sparse:            export.SparseStats(),
+	}
+	if inputSpill != nil {
+		// still held, it is released on return
+		report.StorageUsage = report.StorageUsage.Add(inputSpill.Usage())
+	}
+	return report, nil
 }
 
 func printVerbose(export *Export, newEntryID string) {
-	e := export.Root()
-	for {
-		if e == nil {
-			break
-		}
+	for _, e := range export.Chain() {
 		cmd := strings.Join(e.LayerConfig.ContainerConfig().Cmd, " ")
 		if len(cmd) > 60 {
 			cmd = cmd[:60]
 		}
 
 		if e.LayerConfig.ID == newEntryID {
-			debugf("  -> %s %s\n", e.LayerConfig.ID[0:12], cmd)
+			export.debugf("  -> %s %s\n", truncateID(e.LayerConfig.ID), cmd)
 		} else {
-			debugf("  -  %s %s\n", e.LayerConfig.ID[0:12], cmd)
+			export.debugf("  -  %s %s\n", truncateID(e.LayerConfig.ID), cmd)
 		}
-		e = export.ChildOf(e.LayerConfig.ID)
 	}
 }
@@ -1,9 +1,10 @@
 package libsquash
 
 import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
-	"io/ioutil"
-	"os"
 
 	"github.com/winchman/libsquash/tarball"
 )
@@ -12,69 +13,165 @@ import (
 SquashLayers produces the #(squash) layer from the contents in the tarball,
 rewrites the subsequent layers, using e.RewriteChildren, and then rewrites
 the final image tar by calling e.RebuildImage
+
+The files of the squash layer are read from the offsets recorded by
+IngestImageMetadata, so tarstream must be positioned at the start of the
+tarball that was ingested. If tarstream is not seekable (see Squash), it is
+copied to a spill first. Hard links are resolved across layers, see
+resolveHardLinks, and identical files are merged into hard links if
+Options.Dedup is set
 */
 func (e *Export) SquashLayers(into, from *Layer, tarstream io.Reader, outstream io.Writer) (imageID string, err error) {
-	tempfile, err := ioutil.TempFile("", "libsquash")
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	source, base, ok := seekable(tarstream)
+	if !ok {
+		input, err := e.createSpill()
+		if err != nil {
+			return "", wrapError(PhaseSquash, "", "", err)
+		}
+		defer e.releaseSpill(input)
+		if _, err := io.Copy(input, tarstream); err != nil {
+			return "", wrapError(PhaseSquash, "", "", err)
+		}
+		source, base = input, 0
+	}
+
+	spill, err := e.createSpill()
 	if err != nil {
-		return "", err
+		return "", wrapError(PhaseSquash, "", "", err)
 	}
+	defer e.releaseSpill(spill)
 
-	defer func() {
-		_ = tempfile.Close()
-		_ = os.RemoveAll(tempfile.Name())
-	}()
-
-	var squashLayerTarWriter = tarball.NewTarstream(tempfile)
-
-	// write contents of layer.tar of "squash layer" into tempfile
-	if err = tarball.Walk(tarstream, func(t *tarball.TarFile) error {
-		nameParts := t.NameParts()
-		switch ParseType(t) {
-		case Directory:
-			uuidPart := nameParts[0]
-			e.Layers[uuidPart].DirHeader = t.Header
-		case LayerTar:
-			uuidPart := nameParts[0]
-			e.Layers[uuidPart].LayerTarHeader = t.Header
-			if err := tarball.Walk(t.Stream, func(tf *tarball.TarFile) error {
-				filePath := nameWithoutWhiteoutPrefix(tf.Name())
-				if e.layerToFiles[uuidPart][filePath] {
-					if err := squashLayerTarWriter.Add(&tarball.TarFile{Header: tf.Header, Stream: tf.Stream}); err != nil {
-						return err
-					}
-				}
-				return nil
-			}); err != nil {
-				return err
-			}
-		case Version:
-			uuidPart := nameParts[0]
-			e.Layers[uuidPart].VersionHeader = t.Header
+	digest := sha256.New()
+	var squashLayerTarWriter = tarball.NewTarstreamFormat(io.MultiWriter(spill, digest), e.options.Format)
+
+	// write contents of layer.tar of "squash layer" into spill (the headers
+	// for the other files of each layer were recorded by IngestImageMetadata)
+	files := e.squashFiles()
+	links := e.resolveHardLinks(files)
+	dedup := e.newDeduper(source, base)
+	staged, stagedOffsets, err := e.stageSparseFiles(source, base, files)
+	if staged != nil {
+		defer e.releaseSpill(staged)
+	}
+	if err != nil {
+		return "", wrapError(PhaseSquash, "", "", err)
+	}
+	for _, file := range files {
+		// a dropped file must not be the one a hard link group is written as
+		content := file.content
+		if ok, err := e.allowSpecialFile(file.name, content.header); err != nil {
+			return "", wrapError(PhaseSquash, file.loc.uuid, file.loc.header.Name, err)
+		} else if !ok {
+			continue
+		}
+		header := links.entry(file)
+		e.rewriteHeader(header)
+		if target, err := dedup.link(header, content); err != nil {
+			return "", wrapError(PhaseSquash, file.loc.uuid, file.loc.header.Name, err)
+		} else if target != "" {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = target
+			header.Size = 0
+		}
+		tf := &tarball.TarFile{Header: header}
+		if header.Typeflag != tar.TypeLink && header.Size > 0 {
+			tf.Stream = e.contents(source, base, content)
+		}
+		e.sparseTarFile(tf, content, staged, stagedOffsets[content])
+		if err := squashLayerTarWriter.Add(tf); err != nil {
+			return "", wrapError(PhaseSquash, file.loc.uuid, file.loc.header.Name, err)
 		}
-		return nil
-	}); err != nil {
-		return "", err
 	}
 
-	debugf("Squashing from %s into %s\n", from.LayerConfig.ID[:12], into.LayerConfig.ID[:12])
+	e.debugf("Squashing from %s into %s\n", truncateID(from.LayerConfig.ID), truncateID(into.LayerConfig.ID))
 
 	if err := squashLayerTarWriter.Close(); err != nil {
-		return "", err
+		return "", wrapError(PhaseSquash, into.LayerConfig.ID, "", err)
 	}
 
-	// rewind the tempfile so layer.tar for the squash layer can be read
-	if _, err = tempfile.Seek(0, 0); err != nil {
-		return "", err
-	}
+	// the configs are part of the layer ids, so they are rewritten first
+	e.mapConfigUsers(from)
 
 	// rewrite the subsequent layers
-	debug("  -  Rewriting child history")
-	if err := e.RewriteChildren(from, into.LayerConfig.ID); err != nil {
-		return "", err
+	e.debug("  -  Rewriting child history")
+	if err := e.rewriteChildren(from, into.LayerConfig.ID); err != nil {
+		return "", wrapError(PhaseSquash, "", "", err)
 	}
 
+	// now that its contents and parent are final, give the squash layer its
+	// final id
+	id, err := e.newLayerID(into, hex.EncodeToString(digest.Sum(nil)))
+	if err != nil {
+		return "", wrapError(PhaseSquash, into.LayerConfig.ID, "", err)
+	}
+	e.setLayerID(into, id)
+
 	// rebuild the image tarball for the squashed layer
-	return e.RebuildImage(into, outstream, tempfile)
+	return e.rebuildImage(into, outstream, io.NewSectionReader(spill, 0, spill.Size()), spill.Size())
+}
+
+// squashFile is a file of the squash layer: the entry at loc, written as name
+// with the contents of the entry at content (see fsNode)
+type squashFile struct {
+	name    string
+	loc     fileLoc
+	content fileLoc
+}
+
+/*
+squashFiles returns the files of the squash layer (see mergeLayers) in the
+order they are written, which is a well-formed directory tree:
+
+1. each path is written once, as it is after the last layer that changed it (so
+a directory gets its mode and owner from the last layer that defined it, even
+if another layer spelled its name differently, e.g. "bin" and "bin/")
+
+2. parent directories come before their contents, and siblings are sorted by
+name, so the order does not depend on how the layers were built
+
+3. parent directories that are not in any layer are synthesised: they are owned
+by root, have mode 0755 and the modification time of the file that needed them
+
+Files are written at the path they resolved to (see fsTree.resolve), spelled
+the same way whatever their layer.tar used: without a leading "./" or "/", and
+with a trailing "/" for directories only (see entryName)
+*/
+func (e *Export) squashFiles() []squashFile {
+	var files []squashFile
+	e.tree.walk(func(p string, node *fsNode) {
+		files = append(files, squashFile{name: entryName(p, node.isDir()), loc: node.loc, content: node.content})
+	})
+	return files
+}
+
+// entryName returns the name of the entry for the file at tree path p. The
+// root directory is "./"
+func entryName(p string, dir bool) string {
+	switch {
+	case p == "":
+		return "./"
+	case dir:
+		return p + "/"
+	}
+	return p
+}
+
+// rewriteHeader modifies header (a copy, see hardLinks.entry) in place as
+// configured in e.options
+func (e *Export) rewriteHeader(header *tar.Header) {
+	e.options.Xattrs.apply(header)
+	e.options.IDMap.apply(header)
+	e.hardenMode(header)
+	e.normalizeHeader(header)
+}
+
+// contents returns a reader for the contents of the file at loc in the image
+// tarball at base in source
+func (e *Export) contents(source io.ReaderAt, base int64, loc fileLoc) io.Reader {
+	return io.NewSectionReader(source, base+e.layerOffsets[loc.uuid]+loc.offset, loc.header.Size)
 }
 
 /*
@@ -92,18 +189,18 @@ inherited by the squash layer. The logic is as follows:
 	* the history of that layer and its changes (e.g. new env vars, new workdir, etc.) will be preserved
 */
 func (e *Export) RewriteChildren(from *Layer, squashID string) error {
-	entry := from
-	for {
-		if entry == nil {
-			break
-		}
-		child := e.ChildOf(entry.LayerConfig.ID)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.rewriteChildren(from, squashID)
+}
+
+func (e *Export) rewriteChildren(from *Layer, squashID string) error {
+	for _, entry := range e.chainFrom(from.LayerConfig.ID) {
 		if entry.LayerConfig.ID != squashID {
-			if err := e.ReplaceLayer(entry); err != nil {
-				return err
+			if err := e.replaceLayer(entry); err != nil {
+				return wrapError(PhaseSquash, entry.LayerConfig.ID, "", err)
 			}
 		}
-		entry = child
 	}
 	return nil
 }
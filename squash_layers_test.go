@@ -0,0 +1,72 @@
+package libsquash
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSquashDuplicateEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		want    map[string]string
+	}{
+		{
+			name:    "file twice",
+			entries: []testEntry{testFile("dup", "first"), testFile("dup", "second")},
+			want:    map[string]string{"dup": "file second"},
+		},
+		{
+			name:    "different spellings",
+			entries: []testEntry{testFile("./dup", "first"), testFile("dup", "second"), testFile("./dup", "third")},
+			want:    map[string]string{"dup": "file third"},
+		},
+		{
+			name:    "file then symlink",
+			entries: []testEntry{testFile("dup", "first"), testSymlink("dup", "target")},
+			want:    map[string]string{"dup": "symlink target"},
+		},
+		{
+			name:    "symlink then file",
+			entries: []testEntry{testSymlink("dup", "target"), testFile("dup", "second")},
+			want:    map[string]string{"dup": "file second"},
+		},
+		{
+			name:    "directory then file",
+			entries: []testEntry{testDir("dup/"), testFile("dup/x", "x"), testFile("dup", "second")},
+			want:    map[string]string{"dup": "file second"},
+		},
+		{
+			name:    "file then directory",
+			entries: []testEntry{testFile("dup", "first"), testDir("dup/"), testFile("dup/x", "x")},
+			want:    map[string]string{"dup/": "dir", "dup/x": "file x"},
+		},
+		{
+			name:    "hard link to the first copy",
+			entries: []testEntry{testFile("dup", "first"), testLink("link", "dup"), testFile("dup", "second")},
+			want:    map[string]string{"dup": "file second", "link": "file first"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := testImage(t,
+				testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testDir("etc/")}},
+				testLayer{cmd: "make install", entries: test.entries},
+			)
+			out, _ := testSquash(t, img, Options{})
+			files, names := readTestImage(t, squashLayerTar(t, out))
+			got := map[string]string{}
+			for name, file := range files {
+				if name != "etc/" {
+					got[name] = describeEntry(file)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if len(names) != len(files) {
+				t.Errorf("got entries %q, want each path once", names)
+			}
+		})
+	}
+}
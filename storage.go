@@ -0,0 +1,255 @@
+package libsquash
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+var (
+	// ErrorStorageFull is returned when writing to a Spill would exceed the
+	// size cap of a memory Storage
+	ErrorStorageFull = errors.New("spill storage is full")
+)
+
+/*
+Storage provides the temporary space a squash spills data to: a copy of the
+image tarball (only if the input is not seekable, see Squash) and the layer.tar
+of the squash layer while it is being built. Both are as large as the image
+content, so the choice of Storage determines where that space comes from.
+
+The implementations are NewDirStorage, NewMemoryStorage and NewHybridStorage.
+A Storage may be shared by concurrent squashes
+*/
+type Storage interface {
+	// Create returns a new, empty Spill
+	Create() (Spill, error)
+}
+
+// A Spill is a single temporary file held by a Storage. Data is appended with
+// Write and can be read back at any time with ReadAt
+type Spill interface {
+	io.Writer
+	io.ReaderAt
+
+	// Size returns the number of bytes written to the spill
+	Size() int64
+
+	// Usage returns the bytes held by the spill in memory and on disk
+	Usage() StorageUsage
+
+	// Close releases the space held by the spill
+	Close() error
+}
+
+// StorageUsage is an amount of spill data, by where it is held
+type StorageUsage struct {
+	MemoryBytes int64
+	DiskBytes   int64
+}
+
+// Add returns the sum of u and other
+func (u StorageUsage) Add(other StorageUsage) StorageUsage {
+	return StorageUsage{
+		MemoryBytes: u.MemoryBytes + other.MemoryBytes,
+		DiskBytes:   u.DiskBytes + other.DiskBytes,
+	}
+}
+
+// createSpill creates a spill in the storage configured for e
+func (e *Export) createSpill() (Spill, error) {
+	return e.options.storage().Create()
+}
+
+// releaseSpill closes spill, adding the space it used to the total reported by
+// e.StorageUsage
+func (e *Export) releaseSpill(spill Spill) {
+	e.storageUsage = e.storageUsage.Add(spill.Usage())
+	_ = spill.Close()
+}
+
+// StorageUsage returns the total space used by the spills of e that have been
+// released
+func (e *Export) StorageUsage() StorageUsage {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.storageUsage
+}
+
+// NewDirStorage returns a Storage that spills to files in dir. If dir is
+// empty, the default directory for temporary files is used (see os.TempDir)
+func NewDirStorage(dir string) Storage {
+	return &dirStorage{dir: dir}
+}
+
+type dirStorage struct {
+	dir string
+}
+
+func (d *dirStorage) Create() (Spill, error) {
+	return newFileSpill(d.dir)
+}
+
+/*
+NewMemoryStorage returns a Storage that holds spills in memory. The total size
+of the spills held at any one time is capped at limit bytes; writes beyond that
+fail with ErrorStorageFull. A limit <= 0 means no cap
+*/
+func NewMemoryStorage(limit int64) Storage {
+	return &memoryStorage{limit: limit}
+}
+
+/*
+NewHybridStorage returns a Storage that holds spills in memory until the total
+size of the spills in memory would exceed threshold bytes. At that point, the
+spill being written to is moved to a file in dir (see NewDirStorage) and
+continues there
+*/
+func NewHybridStorage(dir string, threshold int64) Storage {
+	return &memoryStorage{limit: threshold, overflowDir: dir, overflow: true}
+}
+
+// memoryStorage implements both the memory and hybrid storages. The lock
+// guards used, which is shared by all of its spills
+type memoryStorage struct {
+	limit       int64
+	overflow    bool
+	overflowDir string
+
+	lock sync.Mutex
+	used int64
+}
+
+func (m *memoryStorage) Create() (Spill, error) {
+	return &memorySpill{storage: m}, nil
+}
+
+// reserve accounts for n more bytes in memory. It returns false if that would
+// exceed the limit
+func (m *memoryStorage) reserve(n int64) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.limit > 0 && m.used+n > m.limit {
+		return false
+	}
+	m.used += n
+	return true
+}
+
+func (m *memoryStorage) release(n int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.used -= n
+}
+
+// memorySpill holds its data in buf until it overflows to file (hybrid only)
+type memorySpill struct {
+	storage *memoryStorage
+	buf     []byte
+	file    *fileSpill
+}
+
+func (m *memorySpill) Write(p []byte) (int, error) {
+	if m.file != nil {
+		return m.file.Write(p)
+	}
+	if m.storage.reserve(int64(len(p))) {
+		m.buf = append(m.buf, p...)
+		return len(p), nil
+	}
+	if !m.storage.overflow {
+		return 0, ErrorStorageFull
+	}
+
+	// move to disk
+	file, err := newFileSpill(m.storage.overflowDir)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Write(m.buf); err != nil {
+		_ = file.Close()
+		return 0, err
+	}
+	m.storage.release(int64(len(m.buf)))
+	m.buf, m.file = nil, file
+	return m.file.Write(p)
+}
+
+func (m *memorySpill) ReadAt(p []byte, off int64) (int, error) {
+	if m.file != nil {
+		return m.file.ReadAt(p, off)
+	}
+	if off >= int64(len(m.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memorySpill) Size() int64 {
+	if m.file != nil {
+		return m.file.Size()
+	}
+	return int64(len(m.buf))
+}
+
+func (m *memorySpill) Usage() StorageUsage {
+	if m.file != nil {
+		return m.file.Usage()
+	}
+	return StorageUsage{MemoryBytes: int64(len(m.buf))}
+}
+
+func (m *memorySpill) Close() error {
+	if m.file != nil {
+		return m.file.Close()
+	}
+	m.storage.release(int64(len(m.buf)))
+	m.buf = nil
+	return nil
+}
+
+// fileSpill is a Spill backed by a temporary file that is removed on Close
+type fileSpill struct {
+	file *os.File
+	size int64
+}
+
+func newFileSpill(dir string) (*fileSpill, error) {
+	file, err := ioutil.TempFile(dir, "libsquash")
+	if err != nil {
+		return nil, err
+	}
+	return &fileSpill{file: file}, nil
+}
+
+func (f *fileSpill) Write(p []byte) (int, error) {
+	n, err := f.file.WriteAt(p, f.size)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *fileSpill) ReadAt(p []byte, off int64) (int, error) {
+	return f.file.ReadAt(p, off)
+}
+
+func (f *fileSpill) Size() int64 {
+	return f.size
+}
+
+func (f *fileSpill) Usage() StorageUsage {
+	return StorageUsage{DiskBytes: f.size}
+}
+
+func (f *fileSpill) Close() error {
+	err := f.file.Close()
+	if removeErr := os.Remove(f.file.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package libsquash
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// dirEntries returns the number of files in dir
+func dirEntries(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestSpill(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	tests := []struct {
+		name    string
+		storage func(dir string) Storage
+		want    StorageUsage
+	}{
+		{"dir", func(dir string) Storage { return NewDirStorage(dir) }, StorageUsage{DiskBytes: 1000}},
+		{"memory", func(string) Storage { return NewMemoryStorage(0) }, StorageUsage{MemoryBytes: 1000}},
+		{"memory with room", func(string) Storage { return NewMemoryStorage(1000) }, StorageUsage{MemoryBytes: 1000}},
+		{"hybrid in memory", func(dir string) Storage { return NewHybridStorage(dir, 1000) }, StorageUsage{MemoryBytes: 1000}},
+		{"hybrid overflowed", func(dir string) Storage { return NewHybridStorage(dir, 500) }, StorageUsage{DiskBytes: 1000}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			spill, err := test.storage(dir).Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(data); i += 300 {
+				end := i + 300
+				if end > len(data) {
+					end = len(data)
+				}
+				if n, err := spill.Write(data[i:end]); err != nil || n != end-i {
+					t.Fatalf("write: got %d, %v", n, err)
+				}
+			}
+			if spill.Size() != int64(len(data)) {
+				t.Errorf("got size %d, want %d", spill.Size(), len(data))
+			}
+			if usage := spill.Usage(); usage != test.want {
+				t.Errorf("got usage %+v, want %+v", usage, test.want)
+			}
+
+			got, err := io.ReadAll(io.NewSectionReader(spill, 0, spill.Size()))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("got %d bytes back, %v", len(got), err)
+			}
+			part := make([]byte, 20)
+			if n, err := spill.ReadAt(part, 995); n != 5 || err != io.EOF || string(part[:n]) != "56789" {
+				t.Errorf("read past the end: got %q, %v", part[:n], err)
+			}
+
+			if err := spill.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n := dirEntries(t, dir); n != 0 {
+				t.Errorf("got %d files left in the storage directory", n)
+			}
+		})
+	}
+}
+
+func TestMemoryStorageLimit(t *testing.T) {
+	storage := NewMemoryStorage(10)
+	a, _ := storage.Create()
+	b, _ := storage.Create()
+	if _, err := a.Write(make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	// the limit is shared by the spills of the storage
+	if _, err := b.Write(make([]byte, 4)); !errors.Is(err, ErrorStorageFull) {
+		t.Errorf("got %v, want ErrorStorageFull", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write(make([]byte, 10)); err != nil {
+		t.Errorf("got %v once the space is released", err)
+	}
+}
+
+func TestHybridStorageOverflow(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewHybridStorage(dir, 10)
+	a, _ := storage.Create()
+	b, _ := storage.Create()
+	if _, err := a.Write([]byte("01234567")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	// only the spill that no longer fits moves to disk, with its data
+	if _, err := b.Write([]byte("cd")); err != nil {
+		t.Fatal(err)
+	}
+	if usage := a.Usage(); usage != (StorageUsage{MemoryBytes: 8}) {
+		t.Errorf("got usage %+v for the spill in memory", usage)
+	}
+	if usage := b.Usage(); usage != (StorageUsage{DiskBytes: 4}) {
+		t.Errorf("got usage %+v for the spill on disk", usage)
+	}
+	got := make([]byte, 4)
+	if _, err := b.ReadAt(got, 0); err != nil || string(got) != "abcd" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	// the memory it held is released
+	c, _ := storage.Create()
+	if _, err := c.Write([]byte("xy")); err != nil {
+		t.Fatal(err)
+	}
+	if usage := c.Usage(); usage != (StorageUsage{MemoryBytes: 2}) {
+		t.Errorf("got usage %+v, want it in memory", usage)
+	}
+	for _, spill := range []Spill{a, b, c} {
+		if err := spill.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := dirEntries(t, dir); n != 0 {
+		t.Errorf("got %d files left in the storage directory", n)
+	}
+}
+
+func TestSquashStorageUsage(t *testing.T) {
+	img := testImage(t,
+		testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testDir("etc/"), testFile("etc/passwd", "root")}},
+		testLayer{cmd: "make install", entries: []testEntry{testFile("etc/hosts", "localhost")}},
+	)
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		storage Storage
+		memory  bool
+	}{
+		{"dir", NewDirStorage(dir), false},
+		{"memory", NewMemoryStorage(0), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out, idOut bytes.Buffer
+			// not seekable, so that the input is spilled as well
+			report, err := SquashWithOptions(io.MultiReader(bytes.NewReader(img)), &out, &idOut, Options{Storage: test.storage})
+			if err != nil {
+				t.Fatal(err)
+			}
+			usage := report.StorageUsage
+			if inMemory := usage.MemoryBytes > 0 && usage.DiskBytes == 0; inMemory != test.memory {
+				t.Errorf("got usage %+v", usage)
+			}
+			if total := usage.MemoryBytes + usage.DiskBytes; total < int64(len(img)) {
+				t.Errorf("got usage %+v, want at least the %d bytes of the input", usage, len(img))
+			}
+		})
+	}
+	if n := dirEntries(t, dir); n != 0 {
+		t.Errorf("got %d files left in the storage directory", n)
+	}
+}
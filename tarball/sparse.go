@@ -0,0 +1,240 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const blockSize = 512
+
+// SparseEntry is a region of data in a sparse file. The rest of the file is
+// holes, which read as zeroes
+type SparseEntry struct {
+	Offset int64
+	Length int64
+}
+
+// IsSparse returns whether the file described by header is stored as a sparse
+// file, in either the old GNU format or the GNU PAX formats. The tar reader
+// expands sparse files, so reading them gives their full (logical) contents
+func IsSparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// StoredSize returns the number of bytes of data in the sparse file described
+// by entries, i.e. its size without the holes
+func StoredSize(entries []SparseEntry) int64 {
+	var size int64
+	for _, entry := range entries {
+		size += entry.Length
+	}
+	return size
+}
+
+/*
+ScanSparse reads the size bytes of r and returns the regions that hold data.
+The file is scanned in blocks of 512 bytes, and blocks of zeroes are holes. The
+result ends with an entry of length 0 at offset size if the file ends with a
+hole, so that the size of the file is kept by the map
+*/
+func ScanSparse(r io.Reader, size int64) ([]SparseEntry, error) {
+	entries := []SparseEntry{}
+	block := make([]byte, blockSize)
+	zeroes := make([]byte, blockSize)
+	for offset := int64(0); offset < size; offset += blockSize {
+		n := int64(blockSize)
+		if size-offset < n {
+			n = size - offset
+		}
+		if _, err := io.ReadFull(r, block[:n]); err != nil {
+			return nil, err
+		}
+		if bytes.Equal(block[:n], zeroes[:n]) {
+			continue
+		}
+		if last := len(entries) - 1; last >= 0 && entries[last].Offset+entries[last].Length == offset {
+			entries[last].Length += n
+		} else {
+			entries = append(entries, SparseEntry{Offset: offset, Length: n})
+		}
+	}
+	if last := len(entries) - 1; last < 0 || entries[last].Offset+entries[last].Length < size {
+		entries = append(entries, SparseEntry{Offset: size, Length: 0})
+	}
+	return entries, nil
+}
+
+/*
+writeSparse writes the header and data of a sparse file in the GNU PAX sparse
+format 1.0, which archive/tar can read but not write:
+
+1. a PAX extended header with the GNU.sparse records, holding the real name and
+size of the file, and any records of header that are needed
+
+2. a USTAR header for the file, named <dir>/GNUSparseFile.0/<name>, whose size
+is that of the data in the archive
+
+3. the sparse map (the number of entries, then the offset and length of each,
+as decimal numbers on separate lines), padded to a block, followed by the data
+of each entry, read from data, padded to a block
+*/
+func writeSparse(w io.Writer, header *tar.Header, entries []SparseEntry, data io.Reader) error {
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(entries))
+	for _, entry := range entries {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", entry.Offset, entry.Length)
+	}
+	sparseMap.Write(make([]byte, padding(int64(sparseMap.Len()))))
+	storedSize := int64(sparseMap.Len()) + StoredSize(entries)
+
+	records := map[string]string{}
+	for key, value := range header.PAXRecords {
+		switch key {
+		case "path", "linkpath", "size", "uid", "gid", "uname", "gname", "mtime", "atime", "ctime":
+		default:
+			if !strings.HasPrefix(key, "GNU.sparse.") {
+				records[key] = value
+			}
+		}
+	}
+	records["GNU.sparse.major"] = "1"
+	records["GNU.sparse.minor"] = "0"
+	records["GNU.sparse.name"] = header.Name
+	records["GNU.sparse.realsize"] = strconv.FormatInt(header.Size, 10)
+
+	dir, name := path.Split(strings.TrimSuffix(header.Name, "/"))
+	fileHeader := &tar.Header{
+		Name:     path.Join(dir, "GNUSparseFile.0", name),
+		Typeflag: tar.TypeReg,
+		Mode:     header.Mode,
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		ModTime:  header.ModTime,
+		Size:     storedSize,
+	}
+	block := ustarBlock(fileHeader, records)
+
+	paxData := paxRecords(records)
+	paxHeader := ustarBlock(&tar.Header{
+		Name:     path.Join(dir, "PaxHeaders.0", name),
+		Typeflag: tar.TypeXHeader,
+		Size:     int64(len(paxData)),
+		ModTime:  time.Unix(0, 0),
+	}, map[string]string{})
+
+	for _, chunk := range [][]byte{paxHeader, paxData, make([]byte, padding(int64(len(paxData)))), block, sparseMap.Bytes()} {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	written, err := io.Copy(w, io.LimitReader(data, StoredSize(entries)))
+	if err != nil {
+		return err
+	}
+	if written != StoredSize(entries) {
+		return io.ErrUnexpectedEOF
+	}
+	_, err = w.Write(make([]byte, padding(storedSize)))
+	return err
+}
+
+func padding(size int64) int64 {
+	return -size & (blockSize - 1)
+}
+
+// paxRecords formats records as the data of a PAX extended header, sorted by
+// key so that the output is deterministic
+func paxRecords(records map[string]string) []byte {
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		// the length includes itself, so grow it until it is consistent
+		record := fmt.Sprintf(" %s=%s\n", key, records[key])
+		length := len(record)
+		for length != len(strconv.Itoa(length))+len(record) {
+			length = len(strconv.Itoa(length)) + len(record)
+		}
+		fmt.Fprintf(&buf, "%d%s", length, record)
+	}
+	return buf.Bytes()
+}
+
+/*
+ustarBlock formats header as a USTAR header block. Fields that do not fit are
+added to records instead (which must then be written in a PAX extended header
+before the block), and truncated or zeroed in the block
+*/
+func ustarBlock(header *tar.Header, records map[string]string) []byte {
+	block := make([]byte, blockSize)
+	putString := func(field []byte, value, record string) {
+		if len(value) > len(field) || !isASCII(value) {
+			records[record] = value
+			value = value[:0]
+		}
+		copy(field, value)
+	}
+	putOctal := func(field []byte, value int64, record string) {
+		// the field holds len(field)-1 digits and a NUL
+		if value < 0 || value >= 1<<(3*uint(len(field)-1)) {
+			records[record] = strconv.FormatInt(value, 10)
+			value = 0
+		}
+		copy(field, fmt.Sprintf("%0*o", len(field)-1, value))
+	}
+
+	name := header.Name
+	if len(name) > 100 {
+		records["path"] = name
+		name = name[len(name)-100:]
+	}
+	copy(block[0:100], name)
+	copy(block[100:108], fmt.Sprintf("%07o", header.Mode&07777))
+	putOctal(block[108:116], int64(header.Uid), "uid")
+	putOctal(block[116:124], int64(header.Gid), "gid")
+	putOctal(block[124:136], header.Size, "size")
+	putOctal(block[136:148], header.ModTime.Unix(), "mtime")
+	block[156] = header.Typeflag
+	copy(block[257:265], "ustar\x0000")
+	putString(block[265:297], header.Uname, "uname")
+	putString(block[297:329], header.Gname, "gname")
+
+	// the checksum is computed with the checksum field set to spaces
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, b := range block {
+		sum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return block
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r >= 0x80 || r == 0 {
+			return false
+		}
+	}
+	return true
+}
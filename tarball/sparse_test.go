@@ -0,0 +1,193 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sparseContents returns a file of size bytes with data at each offset, and
+// zeroes elsewhere
+func sparseContents(size int64, data map[int64]string) []byte {
+	ret := make([]byte, size)
+	for offset, s := range data {
+		copy(ret[offset:], s)
+	}
+	return ret
+}
+
+func TestScanSparse(t *testing.T) {
+	block := strings.Repeat("x", blockSize)
+	tests := []struct {
+		name     string
+		contents []byte
+		want     []SparseEntry
+	}{
+		{"empty", nil, []SparseEntry{{0, 0}}},
+		{"all holes", make([]byte, 4*blockSize), []SparseEntry{{4 * blockSize, 0}}},
+		{"no holes", []byte(block + block), []SparseEntry{{0, 2 * blockSize}}},
+		{"data in the middle", sparseContents(4*blockSize, map[int64]string{blockSize: block + "y"}), []SparseEntry{{blockSize, 2 * blockSize}, {4 * blockSize, 0}}},
+		{"two regions", sparseContents(5*blockSize, map[int64]string{0: "a", 3 * blockSize: "b"}), []SparseEntry{{0, blockSize}, {3 * blockSize, blockSize}, {5 * blockSize, 0}}},
+		{"partial last block", sparseContents(2*blockSize+10, map[int64]string{2 * blockSize: "z"}), []SparseEntry{{2 * blockSize, 10}}},
+		{"partial last hole", sparseContents(2*blockSize+10, map[int64]string{0: "z"}), []SparseEntry{{0, blockSize}, {2*blockSize + 10, 0}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ScanSparse(bytes.NewReader(test.contents), int64(len(test.contents)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := ScanSparse(bytes.NewReader(make([]byte, 10)), 20); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v for a short file, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// storedData returns the data of the regions of contents, one after the other
+func storedData(contents []byte, entries []SparseEntry) []byte {
+	var ret []byte
+	for _, entry := range entries {
+		ret = append(ret, contents[entry.Offset:entry.Offset+entry.Length]...)
+	}
+	return ret
+}
+
+func TestWriteSparse(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   tar.Header
+		contents []byte
+	}{
+		{
+			name:     "simple",
+			header:   tar.Header{Name: "disk.img", Mode: 0644},
+			contents: sparseContents(1<<20, map[int64]string{4096: "data", 1<<20 - 1: "!"}),
+		},
+		{
+			name:     "trailing hole",
+			header:   tar.Header{Name: "var/lib/sparse", Mode: 0600, Uid: 1000, Gid: 1000, Uname: "user", Gname: "user"},
+			contents: sparseContents(8*blockSize, map[int64]string{0: "head"}),
+		},
+		{
+			name:     "long name",
+			header:   tar.Header{Name: strings.Repeat("dir/", 30) + "file", Mode: 0644},
+			contents: sparseContents(3*blockSize, map[int64]string{blockSize: "data"}),
+		},
+		{
+			name: "large ids and xattrs",
+			header: tar.Header{Name: "bin/tool", Mode: 0755, Uid: 1 << 22, Gid: 100000, PAXRecords: map[string]string{
+				"SCHILY.xattr.security.capability": "\x01\x00\x00\x02",
+				"mtime":                            "ignored",
+			}},
+			contents: sparseContents(2*blockSize, map[int64]string{blockSize: "x"}),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := test.header
+			header.Typeflag, header.Size, header.ModTime = tar.TypeReg, int64(len(test.contents)), time.Unix(1000, 0)
+			entries, err := ScanSparse(bytes.NewReader(test.contents), header.Size)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err := writeSparse(&buf, &header, entries, bytes.NewReader(storedData(test.contents, entries))); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len()%blockSize != 0 {
+				t.Errorf("got %d bytes, not a whole number of blocks", buf.Len())
+			}
+
+			r := tar.NewReader(&buf)
+			got, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != header.Name || got.Size != header.Size || got.Mode != header.Mode || got.Uid != header.Uid || got.Gid != header.Gid || got.Uname != header.Uname || !got.ModTime.Equal(header.ModTime) {
+				t.Errorf("got header %+v, want %+v", got, header)
+			}
+			if !IsSparse(got) {
+				t.Error("got a header that is not sparse")
+			}
+			for key, value := range header.PAXRecords {
+				if strings.HasPrefix(key, "SCHILY.xattr.") && got.PAXRecords[key] != value {
+					t.Errorf("got record %s=%q, want %q", key, got.PAXRecords[key], value)
+				}
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, test.contents) {
+				t.Error("got different contents")
+			}
+			if _, err := r.Next(); err != io.EOF {
+				t.Errorf("got %v after the file, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestWriteSparseShortData(t *testing.T) {
+	header := &tar.Header{Name: "disk.img", Typeflag: tar.TypeReg, Size: 4 * blockSize}
+	entries := []SparseEntry{{0, blockSize}, {4 * blockSize, 0}}
+	if err := writeSparse(io.Discard, header, entries, strings.NewReader("short")); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestTarstreamSparseFormat(t *testing.T) {
+	contents := sparseContents(64*blockSize, map[int64]string{8 * blockSize: "data"})
+	entries := []SparseEntry{{8 * blockSize, blockSize}, {64 * blockSize, 0}}
+	tests := []struct {
+		name   string
+		format tar.Format
+		sparse bool
+	}{
+		{"unknown", tar.FormatUnknown, true},
+		{"PAX", tar.FormatPAX, true},
+		{"USTAR", tar.FormatUSTAR, false},
+		{"GNU", tar.FormatGNU, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if WritesSparse(test.format) != test.sparse {
+				t.Errorf("got WritesSparse %v", !test.sparse)
+			}
+			var buf bytes.Buffer
+			stream := NewTarstreamFormat(&buf, test.format)
+			header := &tar.Header{Name: "disk.img", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents)), ModTime: time.Unix(1000, 0)}
+			if err := stream.Add(&TarFile{Header: header, Stream: bytes.NewReader(storedData(contents, entries)), Sparse: entries}); err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if stored := buf.Len() < len(contents); stored != test.sparse {
+				t.Errorf("got %d bytes for a file of %d bytes", buf.Len(), len(contents))
+			}
+
+			r := tar.NewReader(&buf)
+			got, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if IsSparse(got) != test.sparse {
+				t.Errorf("got IsSparse %v", !test.sparse)
+			}
+			if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, contents) {
+				t.Errorf("got %d bytes, %v", len(data), err)
+			}
+		})
+	}
+}
@@ -2,7 +2,17 @@ package tarball
 
 import (
 	"archive/tar"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrorUnrepresentable is returned by Tarstream.Add when a header cannot
+	// be written in the formats the Tarstream is limited to
+	ErrorUnrepresentable = errors.New("header cannot be written in the tar format")
 )
 
 // Tarstream is a type for writing tarballs
@@ -12,19 +22,45 @@ type Tarstream interface {
 
 	// Add adds tf to the underlying tar writer. First, the header is written.
 	// Then, if tf.Stream is not nil, its contents are copied into underlying
-	// tar writer
+	// tar writer. If tf.Sparse is set, the file is written as a sparse file
+	// in the GNU PAX format 1.0, if the format of the stream allows it (see
+	// NewTarstreamFormat)
 	Add(tf *TarFile) error
 }
 
 // NewTarstream returns a tar stream that wries Add()'ed files to outstream
 func NewTarstream(outstream io.Writer) Tarstream {
+	return NewTarstreamFormat(outstream, tar.FormatUnknown)
+}
+
+/*
+NewTarstreamFormat returns a tar stream like NewTarstream, whose headers are
+written in one of the formats in format (a union, e.g. tar.FormatUSTAR |
+tar.FormatGNU), preferring USTAR, then PAX, then GNU. tar.FormatUnknown leaves
+the choice to archive/tar. The headers are adjusted to fit, dropping only what
+a filesystem image does not need:
+
+1. without PAX, the PAX records that only repeat fields of the header (e.g.
+"path" or "mtime") or describe a sparse file are dropped. If USTAR is allowed,
+so are the access and change times, which USTAR has no fields for
+
+2. without PAX, sparse files are written in full, with their holes filled with
+zeroes
+
+A header that still cannot be written fails Add with ErrorUnrepresentable
+*/
+func NewTarstreamFormat(outstream io.Writer, format tar.Format) Tarstream {
 	return &tarstream{
 		writer: tar.NewWriter(outstream),
+		out:    outstream,
+		format: format,
 	}
 }
 
 type tarstream struct {
 	writer *tar.Writer
+	out    io.Writer // for what writer cannot write itself, see writeSparse
+	format tar.Format
 }
 
 func (t *tarstream) Close() error {
@@ -32,11 +68,87 @@ func (t *tarstream) Close() error {
 }
 
 func (t *tarstream) Add(tf *TarFile) (err error) {
-	if err = t.writer.WriteHeader(tf.Header); err != nil {
+	header, stream := tf.Header, tf.Stream
+	if tf.Sparse != nil {
+		if WritesSparse(t.format) {
+			if err = t.writer.Flush(); err != nil {
+				return
+			}
+			return writeSparse(t.out, header, tf.Sparse, stream)
+		}
+		stream = expandSparse(tf.Sparse, stream)
+	}
+	if t.format != tar.FormatUnknown {
+		header = t.adjust(header)
+	}
+	if err = t.writer.WriteHeader(header); err != nil {
+		if t.format != tar.FormatUnknown {
+			err = fmt.Errorf("%w %v: %v", ErrorUnrepresentable, t.format, err)
+		}
 		return
 	}
-	if tf.Stream != nil {
-		_, err = io.Copy(t.writer, tf.Stream)
+	if stream != nil {
+		_, err = io.Copy(t.writer, stream)
 	}
 	return
 }
+
+// WritesSparse returns whether a Tarstream limited to format (see
+// NewTarstreamFormat) writes sparse files as such, rather than in full
+func WritesSparse(format tar.Format) bool {
+	return format == tar.FormatUnknown || format&tar.FormatPAX != 0
+}
+
+// allows returns whether headers may be written in format
+func (t *tarstream) allows(format tar.Format) bool {
+	return t.format == tar.FormatUnknown || t.format&format != 0
+}
+
+// adjust returns a copy of header limited to the formats of t, see
+// NewTarstreamFormat
+func (t *tarstream) adjust(header *tar.Header) *tar.Header {
+	ret := *header
+	ret.Format = t.format
+	if t.allows(tar.FormatPAX) {
+		return &ret
+	}
+	if t.allows(tar.FormatUSTAR) {
+		ret.AccessTime, ret.ChangeTime = time.Time{}, time.Time{}
+	}
+	if len(header.PAXRecords) > 0 {
+		ret.PAXRecords = map[string]string{}
+		for key, value := range header.PAXRecords {
+			if !basicPAXRecords[key] && !strings.HasPrefix(key, "GNU.sparse.") {
+				ret.PAXRecords[key] = value
+			}
+		}
+	}
+	return &ret
+}
+
+// basicPAXRecords are the PAX records that have a field in the header
+var basicPAXRecords = map[string]bool{
+	"path": true, "linkpath": true, "size": true, "uid": true, "gid": true,
+	"uname": true, "gname": true, "mtime": true, "atime": true, "ctime": true,
+}
+
+// expandSparse returns the full contents of the sparse file with the given
+// data regions, whose data is read from data one region after the other
+func expandSparse(entries []SparseEntry, data io.Reader) io.Reader {
+	var readers []io.Reader
+	var offset int64
+	for _, entry := range entries {
+		readers = append(readers, io.LimitReader(zeroReader{}, entry.Offset-offset), io.LimitReader(data, entry.Length))
+		offset = entry.Offset + entry.Length
+	}
+	return io.MultiReader(readers...)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -13,6 +13,17 @@ import (
 type TarFile struct {
 	Header *tar.Header
 	Stream io.Reader
+
+	// Offset is the offset of the file's contents within the tarball, as set
+	// by Walk. For sparse files, the contents are not stored contiguously, so
+	// the Offset should not be used
+	Offset int64
+
+	// Sparse, if not nil, makes Tarstream.Add write the file as a sparse
+	// file with these data regions. Stream must then only hold the data of
+	// the regions, one after the other, and Header.Size is the full size of
+	// the file
+	Sparse []SparseEntry
 }
 
 // Name returns the name of the file as reported by the header
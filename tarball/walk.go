@@ -9,9 +9,13 @@ import (
 type WalkFunc func(t *TarFile) error
 
 // Walk walks through the files in the tarball represented by tarstream and
-// passes each of them to the WalkFunc provided as an argument
+// passes each of them to the WalkFunc provided as an argument. The Offset of
+// each file is set relative to the position tarstream was at when Walk was
+// called. If tarstream is a working io.ReadSeeker, the contents of files that
+// are not read by walkFunc are skipped by seeking rather than reading
 func Walk(tarstream io.Reader, walkFunc WalkFunc) error {
-	reader := tar.NewReader(tarstream)
+	position := newPositionReader(tarstream)
+	reader := tar.NewReader(position)
 ReadLoop:
 	for {
 		header, err := reader.Next()
@@ -21,9 +25,57 @@ ReadLoop:
 			}
 			return err
 		}
-		if err := walkFunc(&TarFile{Header: header, Stream: reader}); err != nil {
+		offset, err := position.Position()
+		if err != nil {
+			return err
+		}
+		if err := walkFunc(&TarFile{Header: header, Stream: reader, Offset: offset}); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// positionReader keeps track of how far into a stream it is. The tar reader
+// reads the headers of a file exactly, so after reading a header, the
+// position is the offset of the file's contents
+type positionReader interface {
+	io.Reader
+	Position() (int64, error)
+}
+
+func newPositionReader(r io.Reader) positionReader {
+	if seeker, ok := r.(io.ReadSeeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return &seekingReader{ReadSeeker: seeker, start: start}
+		}
+	}
+	return &countingReader{reader: r}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.reader.Read(p)
+	c.count += int64(n)
+	return
+}
+
+func (c *countingReader) Position() (int64, error) {
+	return c.count, nil
+}
+
+// seekingReader exposes Seek, which the tar reader uses to skip contents
+type seekingReader struct {
+	io.ReadSeeker
+	start int64
+}
+
+func (s *seekingReader) Position() (int64, error) {
+	current, err := s.Seek(0, io.SeekCurrent)
+	return current - s.start, err
+}
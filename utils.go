@@ -5,7 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -49,28 +49,29 @@ func newID() (string, error) {
 			return "", err
 		}
 		value := hex.EncodeToString(id)
-		if _, err := strconv.ParseInt(truncateID(value), 10, 64); err == nil {
+		if isNumeric(truncateID(value)) {
 			continue
 		}
 		return value, nil
 	}
 }
 
-func isWhiteout(filepath string) bool {
-	nameParts := strings.Split(filepath, string(os.PathSeparator))
-	fileName := nameParts[len(nameParts)-1]
-	return strings.HasPrefix(fileName, ".wh.")
+// isNumeric returns whether id parses as a number, which the docker daemon
+// does not accept for an id
+func isNumeric(id string) bool {
+	_, err := strconv.ParseInt(id, 10, 64)
+	return err == nil
 }
 
-func nameWithoutWhiteoutPrefix(filepath string) string {
-	return strings.Replace(filepath, ".wh.", "", -1)
+// isWhiteout returns whether the file at tree path p is a whiteout
+func isWhiteout(p string) bool {
+	_, name := splitTreePath(p)
+	return strings.HasPrefix(name, ".wh.")
 }
 
-func matchesWhiteout(filename string, whiteouts []whiteoutFile) (uuidContainingWhiteout string, matches bool) {
-	for _, whiteout := range whiteouts {
-		if strings.HasPrefix(filename, whiteout.prefix) {
-			return whiteout.uuid, true
-		}
-	}
-	return "", false
+// nameWithoutWhiteoutPrefix returns the tree path of the file that whiteout p
+// deletes. Any other p is returned as is
+func nameWithoutWhiteoutPrefix(p string) string {
+	dir, name := splitTreePath(p)
+	return path.Join(dir, strings.TrimPrefix(name, ".wh."))
 }
@@ -0,0 +1,36 @@
+package libsquash
+
+import (
+	"io"
+)
+
+/*
+VerifySquash compares the filesystem a container sees in the image tarball
+read from original with the one in squashed, the image tarball Squash wrote
+for it, and returns the differences (see DiffImages). The squash preserved the
+filesystem if the result is Empty.
+
+The layers below the squash point are left out of the squashed image (see
+RebuildImage); they are taken from original instead, and their files are not
+read again. So beyond reading both images once, only the regular files of the
+squash layer, and those at the same paths in original, are read to compare
+their contents, and only if their sizes match.
+
+The changes made on purpose by the Options of the squash (e.g. IDMap,
+Permissions or Xattrs) are reported as differences as well. Modification times
+are not compared, so Reproducible is not. opts configures how the images are
+read, like for IngestImageMetadata
+*/
+func VerifySquash(original, squashed io.Reader, opts Options) (*ImageDiff, error) {
+	before, err := openImageFiles(original, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer before.close()
+	after, err := openImageFiles(squashed, opts, before)
+	if err != nil {
+		return nil, err
+	}
+	defer after.close()
+	return diffFiles(before, after)
+}
@@ -0,0 +1,61 @@
+package libsquash
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestVerifySquash(t *testing.T) {
+	setuid := testFile("bin/su", "su")
+	setuid.header.Mode = 04755
+	img := testImage(t,
+		testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{
+			testDir("bin/"), testDir("etc/"), testDir("usr/"), testDir("usr/lib/"),
+			testFile("bin/sh", "sh"), testFile("etc/passwd", "root"),
+		}},
+		// the squash point: the layer above is left out of the squashed image
+		testLayer{cmd: "#(nop) #(squash)"},
+		// the layers from the squash point on are merged without those below,
+		// so the symlink is followed only if it is above the squash point
+		testLayer{cmd: "make install", entries: []testEntry{
+			testSymlink("lib", "usr/lib"), testFile("lib/libc.so", "libc"), testFile("etc/a", "old"), testLink("etc/b", "etc/a"),
+			testDir("tmp/"), testFile("tmp/build", "junk"), setuid,
+		}},
+		testLayer{cmd: "make clean", entries: []testEntry{
+			testFile("tmp/.wh.build", ""), testFile("etc/a", "new"), testFile("etc/passwd", "root,app"),
+		}},
+	)
+
+	tests := []struct {
+		name string
+		opts Options
+		want []PathChange
+	}{
+		{"default", Options{}, nil},
+		{"permissions", Options{Permissions: PermissionPolicy{ClearSpecialBits: true}}, []PathChange{
+			{Path: "bin/su", Kind: ChangeModified, Fields: []ChangedField{FieldMode}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, _ := testSquash(t, img, test.opts)
+			if files, _ := readTestImage(t, out); len(files[testLayerID(0)+"/layer.tar"].data) > 1024 {
+				t.Fatal("got the files of the layer below the squash point in the squashed image")
+			}
+			diff, err := VerifySquash(bytes.NewReader(img), bytes.NewReader(out), Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.want == nil {
+				if !diff.Empty() {
+					t.Errorf("got %+v, want no differences", diff.Changes)
+				}
+				return
+			}
+			if !reflect.DeepEqual(diff.Changes, test.want) {
+				t.Errorf("got %+v, want %+v", diff.Changes, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package libsquash
+
+import (
+	"errors"
+	"fmt"
+)
+
+// WarningKind classifies a Warning
+type WarningKind string
+
+const (
+	// WarningUnknownFile is for a file in the image tarball that is not part
+	// of any layer and is not "repositories"
+	WarningUnknownFile WarningKind = "unknown-file"
+
+	// WarningOrphanLayer is for a layer that is not part of the chain from the
+	// root layer to the last layer, or whose json is missing. Its files are
+	// not included in the squash
+	WarningOrphanLayer WarningKind = "orphan-layer"
+
+	// WarningMissingLayerTar is for a layer with a json file but no layer.tar
+	WarningMissingLayerTar WarningKind = "missing-layer-tar"
+
+	// WarningDanglingHardLink is for a hard link whose target is not in the
+	// image. It is left out of the squash layer
+	WarningDanglingHardLink WarningKind = "dangling-hard-link"
+
+	// WarningUnresolvablePath is for a file in a layer.tar whose name cannot
+	// be resolved because of a symlink loop. It is left out of the squash
+	// layer
+	WarningUnresolvablePath WarningKind = "unresolvable-path"
+
+	// WarningUnsafePath is for an entry with an unsafe name that was
+	// sanitized or dropped, see Options.UnsafePaths
+	WarningUnsafePath WarningKind = "unsafe-path"
+
+	// WarningIngestError is for an ingest error that was not fatal because
+	// Options.Lenient was set
+	WarningIngestError WarningKind = "ingest-error"
+)
+
+// Warning is a non-fatal diagnostic collected while ingesting or squashing an
+// image
+type Warning struct {
+	Kind    WarningKind
+	LayerID string // the layer the warning is about, if any
+	Entry   string // the tar entry the warning is about, if any
+	Message string
+}
+
+func (w Warning) String() string {
+	ret := string(w.Kind)
+	if w.LayerID != "" {
+		ret += ": layer " + truncateID(w.LayerID)
+	}
+	if w.Entry != "" {
+		ret += fmt.Sprintf(": entry %q", w.Entry)
+	}
+	return ret + ": " + w.Message
+}
+
+// Warnings returns the diagnostics collected by IngestImageMetadata and
+// SquashLayers
+func (e *Export) Warnings() []Warning {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return append([]Warning{}, e.warnings...)
+}
+
+func (e *Export) warn(kind WarningKind, layerID, entry, message string) {
+	w := Warning{Kind: kind, LayerID: layerID, Entry: entry, Message: message}
+	e.debugf("  !  %s\n", w)
+	e.warnings = append(e.warnings, w)
+}
+
+// tolerate records err as a warning and swallows it in lenient mode. In strict
+// mode, err is returned unchanged
+func (e *Export) tolerate(err error) error {
+	if err == nil || !e.options.Lenient {
+		return err
+	}
+	var squashErr *Error
+	if errors.As(err, &squashErr) {
+		e.warn(WarningIngestError, squashErr.LayerID, squashErr.Entry, squashErr.Err.Error())
+	} else {
+		e.warn(WarningIngestError, "", "", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// withImageFile returns the image tarball img with a file added at the end
+func withImageFile(t *testing.T, img []byte, name, data string) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	r := tar.NewReader(bytes.NewReader(img))
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLenient(t *testing.T) {
+	base := []testLayer{
+		{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testFile("a", "a")}},
+		{cmd: "make install", entries: []testEntry{testFile("b", "b")}},
+	}
+	image := func(last testLayer) []byte {
+		return testImage(t, append(append([]testLayer{}, base...), last)...)
+	}
+	third := testLayer{cmd: "#(nop) ENV A=b", entries: []testEntry{testFile("c", "c")}}
+	withJSON := func(js string) testLayer {
+		layer := third
+		layer.json = []byte(js)
+		return layer
+	}
+	noTar := third
+	noTar.noTar = true
+
+	tests := []struct {
+		name     string
+		img      []byte
+		fatal    bool          // whether strict mode aborts
+		err      error         // the error strict mode aborts with, if it is a sentinel
+		layer    string        // the layer of the error
+		warnings []WarningKind // the warnings of lenient mode, sorted
+		files    int           // the files in the squash layer, in lenient mode
+	}{
+		{
+			name:     "bad layer json",
+			img:      image(withJSON("{")),
+			fatal:    true,
+			layer:    testLayerID(2),
+			warnings: []WarningKind{WarningIngestError, WarningOrphanLayer},
+			files:    2,
+		},
+		{
+			name:     "invalid layer id",
+			img:      image(withJSON(fmt.Sprintf(`{"id":"../x","parent":%q}`, testLayerID(1)))),
+			fatal:    true,
+			err:      ErrorUnsafeLayerID,
+			layer:    testLayerID(2),
+			warnings: []WarningKind{WarningIngestError, WarningOrphanLayer},
+			files:    2,
+		},
+		{
+			name:     "multiple branches",
+			img:      image(withJSON(fmt.Sprintf(`{"id":%q,"parent":%q}`, testLayerID(2), testLayerID(0)))),
+			fatal:    true,
+			err:      ErrorMultipleBranchesSameParent,
+			layer:    testLayerID(0),
+			warnings: []WarningKind{WarningIngestError, WarningOrphanLayer},
+			files:    2,
+		},
+		{
+			name:     "unknown top-level file",
+			img:      withImageFile(t, image(third), "notes.txt", "hello"),
+			warnings: []WarningKind{WarningUnknownFile},
+			files:    3,
+		},
+		{
+			name:     "json without layer.tar",
+			img:      image(noTar),
+			warnings: []WarningKind{WarningMissingLayerTar},
+			files:    2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out, idOut bytes.Buffer
+			report, err := SquashWithOptions(bytes.NewReader(test.img), &out, &idOut, Options{})
+			if test.fatal {
+				var squashErr *Error
+				if !errors.As(err, &squashErr) || squashErr.Phase != PhaseIngest || squashErr.LayerID != test.layer {
+					t.Errorf("strict: got %v, want an ingest error for layer %s", err, truncateID(test.layer))
+				}
+				if test.err != nil && !errors.Is(err, test.err) {
+					t.Errorf("strict: got %v, want %v", err, test.err)
+				}
+				if out.Len() != 0 {
+					t.Errorf("strict: got %d bytes of output", out.Len())
+				}
+			} else if err != nil {
+				t.Errorf("strict: got %v, want the warnings of lenient mode", err)
+			} else if kinds := warningKinds(report.Warnings); !reflect.DeepEqual(kinds, test.warnings) {
+				t.Errorf("strict: got warnings %v, want %v", report.Warnings, test.warnings)
+			}
+
+			out2, report := testSquash(t, test.img, Options{Lenient: true})
+			if kinds := warningKinds(report.Warnings); !reflect.DeepEqual(kinds, test.warnings) {
+				t.Errorf("lenient: got warnings %v, want %v", report.Warnings, test.warnings)
+			}
+			if files, _ := readTestImage(t, squashLayerTar(t, out2)); len(files) != test.files {
+				t.Errorf("lenient: got %d files, want %d", len(files), test.files)
+			}
+		})
+	}
+}
+
+// warningKinds returns the kinds of warnings, sorted
+func warningKinds(warnings []Warning) []WarningKind {
+	ret := []WarningKind{}
+	for _, w := range warnings {
+		ret = append(ret, w.Kind)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
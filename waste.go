@@ -0,0 +1,137 @@
+package libsquash
+
+import (
+	"io"
+	"sort"
+
+	"github.com/winchman/libsquash/tarball"
+)
+
+// WasteReport describes the space taken in an image by files that a later
+// layer overwrote or deleted, which squashing the image reclaims. See
+// AnalyzeWaste
+type WasteReport struct {
+	// OverwrittenBytes is the total size of the files replaced by a later
+	// layer
+	OverwrittenBytes int64
+
+	// DeletedBytes is the total size of the files deleted by a whiteout
+	DeletedBytes int64
+
+	// Files are the wasted files, largest first
+	Files []WastedFile
+
+	// Layers are the waste of each layer, from the root to the last layer
+	Layers []LayerWaste
+}
+
+// WastedFile is a file of a layer that is not in the image
+type WastedFile struct {
+	Path    string
+	LayerID string // the layer the file is in
+	Size    int64  // the bytes it takes in the layer.tar (the data, for a sparse file)
+	Deleted bool   // whether it was deleted by a whiteout, rather than overwritten
+	By      string // the layer that overwrote or deleted it
+}
+
+// LayerWaste is the waste in and caused by a layer
+type LayerWaste struct {
+	LayerID string
+
+	// WastedBytes is the size of the files of the layer that are not in the
+	// image
+	WastedBytes int64
+
+	// CausedBytes is the size of the files that the layer overwrote or
+	// deleted
+	CausedBytes int64
+}
+
+/*
+AnalyzeWaste reads the image tarball from instream and reports the space
+wasted by each layer, without squashing it. The image is read once, as by
+IngestImageMetadata, so the Options that apply to ingest apply here as well
+*/
+func AnalyzeWaste(instream io.Reader, opts Options) (*WasteReport, error) {
+	export := NewExportWithOptions(opts)
+	if err := export.IngestImageMetadata(instream); err != nil {
+		return nil, err
+	}
+	return export.Waste()
+}
+
+/*
+Waste reports the space wasted in the image ingested by e (see
+IngestImageMetadata). All of the layers of the image are merged (see
+mergeLayers), not only those from the squash point on, and a file is wasted if
+it is removed from the merged filesystem and no hard link to its contents
+remains
+*/
+func (e *Export) Waste() (*WasteReport, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	type removal struct {
+		file    WastedFile
+		content fileLoc
+	}
+	var removals []removal
+	tree := newFSTree()
+	tree.onRemove = func(p string, node *fsNode, by fileLoc, deleted bool) {
+		// a hard link takes no space of its own
+		if node.implicit || node.loc != node.content {
+			return
+		}
+		size := node.loc.header.Size
+		if sparse, ok := e.sparse[node.loc]; ok {
+			size = tarball.StoredSize(sparse)
+		}
+		if size > 0 {
+			removals = append(removals, removal{
+				file:    WastedFile{Path: p, LayerID: node.loc.uuid, Size: size, Deleted: deleted, By: by.uuid},
+				content: node.content,
+			})
+		}
+	}
+
+	order, err := e.mergeImage(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	live := map[fileLoc]bool{}
+	tree.walk(func(p string, node *fsNode) {
+		live[node.content] = true
+	})
+
+	chain := e.chain()
+	ret := &WasteReport{Files: []WastedFile{}, Layers: make([]LayerWaste, len(chain))}
+	for i, layer := range chain {
+		ret.Layers[i].LayerID = layer.LayerConfig.ID
+	}
+	for _, r := range removals {
+		if live[r.content] {
+			continue
+		}
+		file := r.file
+		if file.Deleted {
+			ret.DeletedBytes += file.Size
+		} else {
+			ret.OverwrittenBytes += file.Size
+		}
+		ret.Layers[order[file.LayerID]].WastedBytes += file.Size
+		ret.Layers[order[file.By]].CausedBytes += file.Size
+		ret.Files = append(ret.Files, file)
+	}
+	sort.SliceStable(ret.Files, func(i, j int) bool {
+		a, b := ret.Files[i], ret.Files[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		if a.LayerID != b.LayerID {
+			return order[a.LayerID] < order[b.LayerID]
+		}
+		return a.Path < b.Path
+	})
+	return ret, nil
+}
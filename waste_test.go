@@ -0,0 +1,114 @@
+package libsquash
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestWaste(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers []testLayer
+		files  []string // path@layer size, "deleted by" or "overwritten by" layer
+		wasted []int64  // by layer
+		caused []int64  // by layer
+	}{
+		{
+			name: "overwritten and deleted",
+			layers: []testLayer{
+				{entries: []testEntry{testFile("a", "aaaa"), testFile("b", "bb")}},
+				{entries: []testEntry{testFile("a", "x"), testFile(".wh.b", "")}},
+			},
+			files:  []string{"a@0 4 overwritten by 1", "b@0 2 deleted by 1"},
+			wasted: []int64{6, 0},
+			caused: []int64{0, 6},
+		},
+		{
+			name: "kept by a hard link",
+			layers: []testLayer{
+				{entries: []testEntry{testFile("a", "aaaa"), testLink("l", "a")}},
+				{entries: []testEntry{testFile(".wh.a", "")}},
+			},
+			files:  []string{},
+			wasted: []int64{0, 0},
+			caused: []int64{0, 0},
+		},
+		{
+			name: "hard link deleted as well",
+			layers: []testLayer{
+				{entries: []testEntry{testFile("a", "aaaa"), testLink("l", "a")}},
+				{entries: []testEntry{testFile(".wh.a", "")}},
+				{entries: []testEntry{testFile(".wh.l", "")}},
+			},
+			files:  []string{"a@0 4 deleted by 1"},
+			wasted: []int64{4, 0, 0},
+			caused: []int64{0, 4, 0},
+		},
+		{
+			name: "sparse",
+			layers: []testLayer{
+				{raw: sparseLayerTar(t, 4<<20, 1<<20, "data")},
+				{entries: []testEntry{testFile(".wh.disk.img", "")}},
+			},
+			// the block of 512 bytes that holds the data, not the 4MB
+			files:  []string{"disk.img@0 512 deleted by 1"},
+			wasted: []int64{512, 0},
+			caused: []int64{0, 512},
+		},
+		{
+			name: "ranking",
+			layers: []testLayer{
+				{entries: []testEntry{testFile("z", "xxx"), testFile("y", "xxx"), testFile("big", "xxxxx")}},
+				{entries: []testEntry{testFile("y", "1"), testFile("z", "1"), testFile("m", "xxx")}},
+				{entries: []testEntry{testFile("m", "1"), testFile("big", "1")}},
+			},
+			files:  []string{"big@0 5 overwritten by 2", "y@0 3 overwritten by 1", "z@0 3 overwritten by 1", "m@1 3 overwritten by 2"},
+			wasted: []int64{11, 3, 0},
+			caused: []int64{0, 6, 8},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			position := map[string]string{}
+			for i := range test.layers {
+				test.layers[i].cmd = "layer " + strconv.Itoa(i)
+				position[testLayerID(i)] = strconv.Itoa(i)
+			}
+			report, err := AnalyzeWaste(bytes.NewReader(testImage(t, test.layers...)), Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files := []string{}
+			var overwritten, deleted int64
+			for _, file := range report.Files {
+				how := "overwritten"
+				if file.Deleted {
+					how = "deleted"
+					deleted += file.Size
+				} else {
+					overwritten += file.Size
+				}
+				files = append(files, fmt.Sprintf("%s@%s %d %s by %s", file.Path, position[file.LayerID], file.Size, how, position[file.By]))
+			}
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("got files %q, want %q", files, test.files)
+			}
+			if report.OverwrittenBytes != overwritten || report.DeletedBytes != deleted {
+				t.Errorf("got %d bytes overwritten and %d deleted, want %d and %d", report.OverwrittenBytes, report.DeletedBytes, overwritten, deleted)
+			}
+
+			if len(report.Layers) != len(test.layers) {
+				t.Fatalf("got %d layers, want %d", len(report.Layers), len(test.layers))
+			}
+			for i, layer := range report.Layers {
+				if layer.LayerID != testLayerID(i) || layer.WastedBytes != test.wasted[i] || layer.CausedBytes != test.caused[i] {
+					t.Errorf("layer %d: got %+v, want %d bytes wasted and %d caused", i, layer, test.wasted[i], test.caused[i])
+				}
+			}
+		})
+	}
+}
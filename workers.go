@@ -0,0 +1,37 @@
+package libsquash
+
+import "sync"
+
+// parallelize calls work(i) for each i in [0, n), with at most limit calls
+// running at once. It returns the error of the smallest i that failed, so the
+// error does not depend on scheduling
+func parallelize(n, limit int, work func(i int) error) error {
+	if limit < 1 {
+		limit = 1
+	}
+	errs := make([]error, n)
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < limit && worker < n; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = work(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
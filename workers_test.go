@@ -0,0 +1,89 @@
+package libsquash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParallelize(t *testing.T) {
+	var running, most int32
+	var calls [20]int32
+	err := parallelize(len(calls), 4, func(i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		atomic.AddInt32(&calls[i], 1)
+		if i == 7 || i == 13 {
+			return fmt.Errorf("work %d", i)
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "work 7" {
+		t.Errorf("got %v, want the error of the smallest index", err)
+	}
+	if most > 4 {
+		t.Errorf("got %d calls at once, want at most 4", most)
+	}
+	for i, n := range calls {
+		if n != 1 {
+			t.Errorf("work %d: called %d times", i, n)
+		}
+	}
+}
+
+// concurrencyTestImage returns an image with enough layers for them to be
+// read concurrently
+func concurrencyTestImage(t *testing.T) []byte {
+	layers := []testLayer{{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testDir("etc/"), testDir("usr/"), testFile("etc/passwd", "root")}}}
+	for i := 1; i < 12; i++ {
+		entries := []testEntry{
+			testFile(fmt.Sprintf("usr/file%d", i), fmt.Sprintf("contents %d", i)),
+			testFile("etc/passwd", fmt.Sprintf("root,user%d", i)),
+		}
+		if i > 1 {
+			entries = append(entries, testFile(fmt.Sprintf("usr/.wh.file%d", i-1), ""), testLink(fmt.Sprintf("usr/link%d", i), "etc/passwd"))
+		}
+		layers = append(layers, testLayer{cmd: fmt.Sprintf("step %d", i), entries: entries})
+	}
+	return testImage(t, layers...)
+}
+
+func TestSquashConcurrency(t *testing.T) {
+	img := concurrencyTestImage(t)
+	want, _ := testSquash(t, img, Options{Reproducible: true, Concurrency: 1})
+	got, _ := testSquash(t, img, Options{Reproducible: true, Concurrency: 8})
+	if !bytes.Equal(got, want) {
+		t.Error("got different output with Concurrency 8 and 1")
+	}
+
+	// squashes on separate Exports do not share state
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var out, idOut bytes.Buffer
+			if _, err := SquashWithOptions(bytes.NewReader(img), &out, &idOut, Options{Reproducible: true, Concurrency: 4}); err != nil {
+				errs[i] = err
+			} else if !bytes.Equal(out.Bytes(), want) {
+				errs[i] = errors.New("got different output")
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("squash %d: %v", i, err)
+		}
+	}
+}
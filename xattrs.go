@@ -0,0 +1,87 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"strings"
+)
+
+// paxXattrPrefix is the prefix of the PAX records that hold extended
+// attributes, see archive/tar
+const paxXattrPrefix = "SCHILY.xattr."
+
+/*
+XattrPolicy selects the extended attributes kept in the squash layer, by
+namespace. A namespace matches the attributes with that name or that start with
+it followed by a ".", so "security" matches "security.capability" and
+"security.selinux", while "security.selinux" only matches itself.
+
+An attribute is kept if it matches no namespace in Strip and, if Allow is not
+nil, a namespace in Allow. For example, Strip: []string{"security.selinux"}
+drops SELinux labels, and Allow: []string{"security.capability"} keeps file
+capabilities and nothing else
+*/
+type XattrPolicy struct {
+	Allow []string
+	Strip []string
+}
+
+func (p XattrPolicy) keeps(name string) bool {
+	if matchesXattrNamespace(name, p.Strip) {
+		return false
+	}
+	return p.Allow == nil || matchesXattrNamespace(name, p.Allow)
+}
+
+func matchesXattrNamespace(name string, namespaces []string) bool {
+	for _, namespace := range namespaces {
+		namespace = strings.TrimSuffix(namespace, ".")
+		if name == namespace || strings.HasPrefix(name, namespace+".") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+apply filters the extended attributes of header in place. archive/tar reports
+them twice, in the deprecated Xattrs and as PAX records, so they are collected
+from both and written back as PAX records only:
+
+1. records that are not extended attributes are kept as they are
+
+2. kept attributes are stored in a new PAXRecords map, since the original one
+is shared with the ingested header
+
+3. if any attributes are left, the header is made to use the PAX format,
+which is the only one that can hold them
+*/
+func (p XattrPolicy) apply(header *tar.Header) {
+	xattrs := map[string]string{}
+	for name, value := range header.Xattrs {
+		xattrs[name] = value
+	}
+	records := map[string]string{}
+	for key, value := range header.PAXRecords {
+		if name := strings.TrimPrefix(key, paxXattrPrefix); name != key {
+			xattrs[name] = value
+		} else {
+			records[key] = value
+		}
+	}
+	if len(xattrs) == 0 {
+		return
+	}
+
+	kept := 0
+	for name, value := range xattrs {
+		if p.keeps(name) {
+			records[paxXattrPrefix+name] = value
+			kept++
+		}
+	}
+	header.Xattrs = nil
+	header.PAXRecords = records
+	if kept > 0 && header.Format != tar.FormatUnknown && header.Format&tar.FormatPAX == 0 {
+		header.Format = tar.FormatPAX
+	}
+}
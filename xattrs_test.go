@@ -0,0 +1,136 @@
+package libsquash
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/winchman/libsquash/tarball"
+)
+
+const testCapability = "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+func TestXattrPolicy(t *testing.T) {
+	xattrs := map[string]string{
+		"security.capability": testCapability,
+		"security.selinux":    "system_u:object_r:bin_t:s0",
+		"user.comment":        "ping",
+	}
+	tests := []struct {
+		name   string
+		policy XattrPolicy
+		want   []string
+	}{
+		{"keep all", XattrPolicy{}, []string{"security.capability", "security.selinux", "user.comment"}},
+		{"strip attribute", XattrPolicy{Strip: []string{"security.selinux"}}, []string{"security.capability", "user.comment"}},
+		{"strip namespace", XattrPolicy{Strip: []string{"security"}}, []string{"user.comment"}},
+		{"strip namespace with dot", XattrPolicy{Strip: []string{"security."}}, []string{"user.comment"}},
+		{"strip prefix only", XattrPolicy{Strip: []string{"secur"}}, []string{"security.capability", "security.selinux", "user.comment"}},
+		{"allow attribute", XattrPolicy{Allow: []string{"security.capability"}}, []string{"security.capability"}},
+		{"allow namespace", XattrPolicy{Allow: []string{"security"}}, []string{"security.capability", "security.selinux"}},
+		{"allow nothing", XattrPolicy{Allow: []string{}}, nil},
+		{"strip wins", XattrPolicy{Allow: []string{"security"}, Strip: []string{"security.selinux"}}, []string{"security.capability"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := &tar.Header{Name: "bin/ping", Format: tar.FormatPAX, PAXRecords: map[string]string{"comment": "kept"}}
+			for name, value := range xattrs {
+				header.PAXRecords[paxXattrPrefix+name] = value
+			}
+			test.policy.apply(header)
+
+			want := map[string]string{"comment": "kept"}
+			for _, name := range test.want {
+				want[paxXattrPrefix+name] = xattrs[name]
+			}
+			if !reflect.DeepEqual(header.PAXRecords, want) {
+				t.Errorf("got records %q, want %q", header.PAXRecords, want)
+			}
+		})
+	}
+}
+
+func TestXattrsSurviveTarstream(t *testing.T) {
+	tests := []struct {
+		name   string
+		header tar.Header
+	}{
+		{"PAX records", tar.Header{Format: tar.FormatPAX, PAXRecords: map[string]string{paxXattrPrefix + "security.capability": testCapability}}},
+		{"Xattrs in GNU header", tar.Header{Format: tar.FormatGNU, Xattrs: map[string]string{"security.capability": testCapability}}},
+		{"Xattrs without format", tar.Header{Xattrs: map[string]string{"security.capability": testCapability}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := test.header
+			header.Name, header.Typeflag, header.Mode, header.Size = "bin/ping", tar.TypeReg, 0755, 4
+			XattrPolicy{}.apply(&header)
+
+			var buf bytes.Buffer
+			stream := tarball.NewTarstream(&buf)
+			if err := stream.Add(&tarball.TarFile{Header: &header, Stream: bytes.NewReader([]byte("ping"))}); err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := tar.NewReader(&buf)
+			got, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value := got.PAXRecords[paxXattrPrefix+"security.capability"]; value != testCapability {
+				t.Errorf("got capability %q, want %q", value, testCapability)
+			}
+			if data, err := io.ReadAll(r); err != nil || string(data) != "ping" {
+				t.Errorf("got contents %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestSquashXattrs(t *testing.T) {
+	ping := testFile("bin/ping", "ping")
+	ping.header.PAXRecords = map[string]string{
+		paxXattrPrefix + "security.capability": testCapability,
+		paxXattrPrefix + "security.selinux":    "system_u:object_r:ping_exec_t:s0",
+	}
+	img := testImage(t,
+		testLayer{cmd: "#(nop) ADD file:root in /", entries: []testEntry{testDir("bin/"), ping}},
+		testLayer{cmd: "echo true > /bin/true", entries: []testEntry{testFile("bin/true", "true")}},
+	)
+
+	tests := []struct {
+		name   string
+		policy XattrPolicy
+		want   map[string]string
+	}{
+		{"keep all", XattrPolicy{}, ping.header.PAXRecords},
+		{"strip selinux", XattrPolicy{Strip: []string{"security.selinux"}}, map[string]string{paxXattrPrefix + "security.capability": testCapability}},
+		{"allow user", XattrPolicy{Allow: []string{"user"}}, map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, _ := testSquash(t, img, Options{Xattrs: test.policy})
+			files, _ := readTestImage(t, squashLayerTar(t, out))
+			file, ok := files["bin/ping"]
+			if !ok {
+				t.Fatal("bin/ping is not in the squash layer")
+			}
+			got := map[string]string{}
+			for key, value := range file.header.PAXRecords {
+				if key != "mtime" && key != "atime" && key != "ctime" {
+					got[key] = value
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got records %q, want %q", got, test.want)
+			}
+			if string(file.data) != "ping" {
+				t.Errorf("got contents %q", file.data)
+			}
+		})
+	}
+}